@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// compares creating a session and client for every request against sharing one client,
+// by sending concurrent HEAD requests for a small object uploaded just for the benchmark
+func benchCommand(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	requests := flags.Int("requests", 1000, "how many requests to send for each run")
+	concurrency := flags.Int("concurrency", 32, "how many requests are sent at the same time")
+	flags.Parse(args)
+
+	spaces, ok := unwrapStorage(cdnStorage).(*SpacesStorage)
+	if !ok {
+		log.Fatal("The bench command needs the spaces storage driver")
+	}
+
+	ctx := context.Background()
+	key := "bench-" + randSeq(8) + ".txt"
+	body := []byte("cdn benchmark")
+
+	err := spaces.Put(ctx, key, bytes.NewReader(body), &PutOptions{
+		Size:        int64(len(body)),
+		ContentType: "text/plain",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer spaces.Delete(ctx, key)
+
+	perRequest := func() error {
+		s, err := session.NewSession(spacesAWSConfig(spaces.config))
+		if err != nil {
+			return err
+		}
+
+		_, err = s3.New(s).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(spaces.config.SpacesName),
+			Key:    aws.String(key),
+		})
+		return err
+	}
+
+	shared := func() error {
+		_, err := spaces.Head(ctx, key)
+		return err
+	}
+
+	runs := []struct {
+		name string
+		run  func() error
+	}{
+		{"session per request", perRequest},
+		{"shared client", shared},
+	}
+
+	for _, bench := range runs {
+		elapsed, failed := runConcurrently(*requests, *concurrency, bench.run)
+		log.Printf("%-20v %v requests in %v, %.1f req/s, %v failed",
+			bench.name, *requests, elapsed.Round(time.Millisecond), float64(*requests)/elapsed.Seconds(), failed)
+	}
+}
+
+func runConcurrently(requests int, concurrency int, run func() error) (time.Duration, int64) {
+	var failed int64
+	var wg sync.WaitGroup
+	jobs := make(chan struct{})
+	start := time.Now()
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range jobs {
+				if err := run(); err != nil {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < requests; i++ {
+		jobs <- struct{}{}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	return time.Since(start), failed
+}
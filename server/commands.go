@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// commands that can be run instead of the server with `cdn <command> [flags]`
+var commands = map[string]func(args []string){
+	"bench":     benchCommand,
+	"reconcile": reconcileCommand,
+	"users":     usersCommand,
+	"keys":      keysCommand,
+}
+
+func runCommand(name string, args []string) {
+	command, ok := commands[name]
+	if !ok {
+		log.Fatalf("Unknown command %v", name)
+	}
+
+	command(args)
+	os.Exit(0)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var errInvalidRange = errors.New("invalid range")
+
+// counts a download once the object is open, returning what to do after the body has been sent
+type downloadCounter func() (func(), error)
+
+// serves a file, counting the download when it has a limit. the record is nil for files the index doesn't know about
+func sendFile(ctx *fiber.Ctx, file *File, info *ObjectInfo, attachment bool) error {
+	if file == nil || !file.proxied() {
+		return sendObject(ctx, info, attachment, nil)
+	}
+
+	ctx.Set("Cache-Control", "no-store")
+
+	// a HEAD request sends no body, so it doesn't use up a download
+	if file.MaxDownloads == 0 || ctx.Method() == fiber.MethodHead {
+		return sendObject(ctx, info, attachment, nil)
+	}
+
+	// every response sends the whole file so nothing is served without being counted
+	ctx.Request().Header.Del("Range")
+	ctx.Request().Header.Del("If-None-Match")
+	ctx.Request().Header.Del("If-Modified-Since")
+
+	return sendObject(ctx, info, attachment, func() (func(), error) {
+		file, err := cdnMetadata.CountDownload(ctx.Context(), file.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if file.Downloads < file.MaxDownloads {
+			return nil, nil
+		}
+
+		return func() {
+			if _, respErr := PurgeFile(context.Background(), file.ID); respErr != nil {
+				log.Printf("Failed to delete %v after its last download: %v", file.ID, respErr.Message)
+			}
+		}, nil
+	})
+}
+
+// streams an object from storage, honouring conditional and range requests.
+// count is only called once the object could be opened, so failed downloads aren't counted
+func sendObject(ctx *fiber.Ctx, info *ObjectInfo, attachment bool, count downloadCounter) error {
+	ctx.Set("Accept-Ranges", "bytes")
+	ctx.Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	if info.ETag != "" {
+		ctx.Set("ETag", info.ETag)
+	}
+
+	if attachment {
+		ctx.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, info.Key))
+	}
+
+	if notModified(ctx, info) {
+		return ctx.SendStatus(fiber.StatusNotModified)
+	}
+
+	rng, err := requestedRange(ctx, info)
+	if err != nil {
+		ctx.Set("Content-Range", fmt.Sprintf("bytes */%v", info.Size))
+		return ctx.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+	}
+
+	reader, _, err := cdnStorage.Get(ctx.Context(), info.Key, rng)
+	if err != nil {
+		return storageError(err)
+	}
+
+	done := func() {}
+	if count != nil {
+		after, err := count()
+		if err != nil {
+			reader.Close()
+			return storageError(err)
+		}
+
+		if after != nil {
+			done = after
+		}
+	}
+
+	// the stream is sent after the handler returns, so wait for it to be closed
+	body := &closeNotifier{ReadCloser: reader, done: done}
+
+	ctx.Set("Content-Type", info.ContentType)
+
+	if rng == nil {
+		return ctx.SendStream(body, int(info.Size))
+	}
+
+	ctx.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", rng.Start, rng.Start+rng.Length-1, info.Size))
+	ctx.Status(fiber.StatusPartialContent)
+
+	return ctx.SendStream(body, int(rng.Length))
+}
+
+// calls done once the body is closed
+type closeNotifier struct {
+	io.ReadCloser
+	done func()
+}
+
+func (body *closeNotifier) Close() error {
+	err := body.ReadCloser.Close()
+	body.done()
+
+	return err
+}
+
+// checks If-None-Match and If-Modified-Since, the latter is ignored when an etag was sent
+func notModified(ctx *fiber.Ctx, info *ObjectInfo) bool {
+	if match := ctx.Get("If-None-Match"); match != "" {
+		return etagMatches(match, info.ETag)
+	}
+
+	if since := ctx.Get("If-Modified-Since"); since != "" {
+		date, err := http.ParseTime(since)
+		return err == nil && !info.LastModified.Truncate(time.Second).After(date)
+	}
+
+	return false
+}
+
+// weakly compares a list of etags from a header against the etag of the object
+func etagMatches(header string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parses the Range header, returning nil when the whole object should be sent.
+// only a single range is supported, requests for several get the whole object
+func requestedRange(ctx *fiber.Ctx, info *ObjectInfo) (*ByteRange, error) {
+	header := ctx.Get("Range")
+	if header == "" || !strings.HasPrefix(header, "bytes=") || !rangeStillValid(ctx, info) {
+		return nil, nil
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 || info.Size == 0 {
+		return nil, errInvalidRange
+	}
+
+	// a suffix range, the last n bytes
+	if parts[0] == "" {
+		length, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || length <= 0 {
+			return nil, errInvalidRange
+		}
+
+		if length > info.Size {
+			length = info.Size
+		}
+
+		return &ByteRange{Start: info.Size - length, Length: length}, nil
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 || start >= info.Size {
+		return nil, errInvalidRange
+	}
+
+	end := info.Size - 1
+	if parts[1] != "" {
+		last, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || last < start {
+			return nil, errInvalidRange
+		}
+
+		if last < end {
+			end = last
+		}
+	}
+
+	return &ByteRange{Start: start, Length: end - start + 1}, nil
+}
+
+// a range only applies if the object still matches the If-Range header
+func rangeStillValid(ctx *fiber.Ctx, info *ObjectInfo) bool {
+	ifRange := ctx.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) {
+		return info.ETag != "" && ifRange == info.ETag
+	}
+
+	date, err := http.ParseTime(ifRange)
+	return err == nil && info.LastModified.Truncate(time.Second).Equal(date)
+}
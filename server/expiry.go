@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// how often expired files are looked for, until then they're already not served
+const expiryCheckInterval = time.Minute
+
+// how many expired files are looked up at once
+const expiryBatchSize = 500
+
+// deletes every expired file from storage, the index and its folders, skipping the trash
+func PurgeExpired(ctx context.Context) (int, error) {
+	purged := 0
+
+	for {
+		files, err := cdnMetadata.ListExpiredFiles(ctx, time.Now(), expiryBatchSize)
+		if err != nil {
+			return purged, err
+		}
+
+		batch := 0
+		for _, file := range files {
+			// one file that fails shouldn't keep the rest around, it's tried again next time
+			if _, respErr := PurgeFile(ctx, file.ID); respErr != nil {
+				log.Printf("Failed to delete expired file %v: %v", file.ID, respErr.Message)
+				continue
+			}
+
+			batch++
+		}
+
+		purged += batch
+
+		// a full batch of files that failed would only be listed again
+		if len(files) < expiryBatchSize || batch == 0 {
+			return purged, nil
+		}
+	}
+}
+
+func startExpiryPurger() {
+	go func() {
+		for {
+			purged, err := PurgeExpired(context.Background())
+			if err != nil {
+				log.Printf("Failed to delete expired files: %v", err)
+			} else if purged > 0 {
+				log.Printf("Deleted %v expired files", purged)
+			}
+
+			time.Sleep(expiryCheckInterval)
+		}
+	}()
+}
@@ -1,158 +1,897 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gofiber/fiber/v2"
 )
 
+// the record of an uploaded file kept in the metadata store, the id is the key in storage
 type File struct {
-	ID    string `json:"id"`
-	Ext   string `json:"ext"`
-	Owner string `json:"owner"`
-	Size  int64  `json:"size"`
+	ID          string    `json:"id"`
+	Ext         string    `json:"ext"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Owner       string    `json:"owner"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	MD5         string    `json:"md5"`
+	Uploaded    time.Time `json:"uploaded"`
+	// when the file was moved to the trash
+	Deleted *time.Time `json:"deleted,omitempty"`
+	// when the file stops being served and gets deleted
+	Expires *time.Time `json:"expires,omitempty"`
+	// how many times the file can be downloaded before it's deleted, 0 for no limit
+	MaxDownloads int `json:"max_downloads,omitempty"`
+	Downloads    int `json:"downloads"`
+	// the hash of the password needed to download the file, see hashPassword
+	PasswordHash string `json:"password_hash,omitempty"`
+	// private files are only served with a signed link
+	Private bool `json:"private,omitempty"`
 }
 
-func UploadFile(s *session.Session, ctx *fiber.Ctx) (string, *JSONResponse) {
-	fileHeader, err := ctx.FormFile("file")
+var ErrFileExpired = errors.New("file expired")
+
+// what the uploader chose for a file besides its contents
+type UploadOptions struct {
+	Owner        string
+	Expires      *time.Time
+	MaxDownloads int
+	PasswordHash string
+	Private      bool
+}
+
+// reads the upload options from form fields or metadata, relative times start now
+func parseUploadOptions(get func(key string) string) (*UploadOptions, *JSONResponse) {
+	opts := new(UploadOptions)
+
+	if expiresIn := get("expires_in"); expiresIn != "" {
+		seconds, err := strconv.ParseInt(expiresIn, 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, NewResponse(fiber.StatusBadRequest, "Expires in must be a positive number of seconds.")
+		}
+
+		expires := time.Now().UTC().Add(time.Duration(seconds) * time.Second)
+		opts.Expires = &expires
+	}
+
+	if expiresAt := get("expires_at"); expiresAt != "" {
+		if opts.Expires != nil {
+			return nil, NewResponse(fiber.StatusBadRequest, "Only one of expires in and expires at can be set.")
+		}
+
+		expires, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil || !expires.After(time.Now()) {
+			return nil, NewResponse(fiber.StatusBadRequest, "Expires at must be an RFC 3339 date in the future.")
+		}
+
+		expires = expires.UTC()
+		opts.Expires = &expires
+	}
+
+	if maxDownloads := get("max_downloads"); maxDownloads != "" {
+		count, err := strconv.Atoi(maxDownloads)
+		if err != nil || count <= 0 {
+			return nil, NewResponse(fiber.StatusBadRequest, "Max downloads must be a positive number.")
+		}
+
+		opts.MaxDownloads = count
+	}
+
+	if get("burn_after_read") == "true" {
+		opts.MaxDownloads = 1
+	}
+
+	switch get("visibility") {
+	case "", "public":
+	case "private":
+		opts.Private = true
+	default:
+		return nil, NewResponse(fiber.StatusBadRequest, "Visibility must be public or private.")
+	}
+
+	if password := get("password"); password != "" {
+		if len(password) > maxPasswordLength {
+			return nil, NewResponse(fiber.StatusBadRequest, fmt.Sprintf("Password can be at most %v characters.", maxPasswordLength))
+		}
+
+		hash, err := hashPassword(password)
+		if err != nil {
+			return nil, NewResponseByError(fiber.StatusInternalServerError, err)
+		}
+
+		opts.PasswordHash = hash
+	}
+
+	return opts, nil
+}
+
+// whether the upload has none of the options, only those uploads are deduplicated
+func (opts *UploadOptions) plain() bool {
+	return opts.Expires == nil && opts.MaxDownloads == 0 && opts.PasswordHash == "" && !opts.Private
+}
+
+// private files and files with a download limit or password aren't publicly readable in storage
+func (opts *UploadOptions) private() bool {
+	return opts.Private || opts.MaxDownloads > 0 || opts.PasswordHash != ""
+}
+
+// reads the form as it's received and stores the file straight from the request body, so uploads
+// don't have to fit in memory. options have to come before the file as it's stored by the time
+// anything after it arrives
+func UploadFile(ctx *fiber.Ctx) (string, *JSONResponse) {
+	boundary := string(ctx.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return "", NewResponse(fiber.StatusBadRequest, "Upload must be a multipart form.")
+	}
+
+	body := ctx.Request().BodyStream()
+	if body == nil {
+		body = bytes.NewReader(ctx.Body())
+	}
+
+	form := multipart.NewReader(body, boundary)
+	fields := make(map[string]string)
+
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return "", NewResponse(fiber.StatusBadRequest, "No file uploaded.")
+		} else if err != nil {
+			return "", NewResponse(fiber.StatusBadRequest, "Failed to read upload.")
+		}
+
+		if part.FormName() != "file" || part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+			if err != nil {
+				return "", NewResponse(fiber.StatusBadRequest, "Failed to read upload.")
+			} else if len(value) > maxFieldSize {
+				return "", NewResponse(fiber.StatusBadRequest, fmt.Sprintf("Form fields can be at most %v bytes.", maxFieldSize))
+			}
+
+			fields[part.FormName()] = string(value)
+			continue
+		}
+
+		opts, respErr := parseUploadOptions(func(key string) string {
+			return fields[key]
+		})
+		if respErr != nil {
+			return "", respErr
+		}
+
+		opts.Owner = currentUser(ctx).UID
+
+		// refused before anything is stored when the owner can't upload at all
+		if respErr := checkQuota(ctx.Context(), opts.Owner, 0); respErr != nil {
+			return "", respErr
+		}
+
+		file, respErr := storeUpload(ctx.Context(), part, part.FileName(), opts)
+		if respErr != nil {
+			return "", respErr
+		}
+
+		// options after the file would be silently ignored, a password for example
+		if _, err := form.NextPart(); err != io.EOF {
+			discardStoredUpload(ctx.Context(), file.ID)
+			return "", NewResponse(fiber.StatusBadRequest, "Upload options have to be sent before the file.")
+		}
+
+		return saveStoredUpload(ctx.Context(), file, opts)
+	}
+}
+
+// the largest form field besides the file
+const maxFieldSize = 64 * 1024
+
+var errUploadTooLarge = errors.New("upload is too large")
+
+// fails once more than the limit was read, so a stream that's too big is stopped while it's stored
+type limitedReader struct {
+	io.Reader
+	left int64
+}
+
+func (reader *limitedReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	reader.left -= int64(n)
+	if reader.left < 0 {
+		return n, errUploadTooLarge
+	}
+
+	return n, err
+}
+
+// counts the bytes written to it
+type byteCounter int64
+
+func (counter *byteCounter) Write(p []byte) (int, error) {
+	*counter += byteCounter(len(p))
+	return len(p), nil
+}
+
+// stores a stream of unknown size under a new random name, hashing it on the way. the returned
+// record isn't saved yet, see saveStoredUpload. until then the upload is pending so the object
+// isn't served without its options
+func storeUpload(ctx context.Context, body io.Reader, name string, opts *UploadOptions) (*File, *JSONResponse) {
+	if cdnConfig.MaxUploadSize > 0 {
+		body = &limitedReader{Reader: body, left: cdnConfig.MaxUploadSize}
+	}
+
+	// the start stays buffered after sniffing the content type so it's still stored
+	buffered := bufio.NewReaderSize(body, 512)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, uploadReadError(err)
+	}
+
+	sha, md := sha256.New(), md5.New()
+	size := new(byteCounter)
+	reader := io.TeeReader(buffered, io.MultiWriter(sha, md, size))
+
+	ext := filepath.Ext(name)
+	file := &File{
+		ID:           randSeq(8) + ext,
+		Ext:          ext,
+		Name:         name,
+		ContentType:  http.DetectContentType(head),
+		Owner:        opts.Owner,
+		Uploaded:     time.Now().UTC(),
+		Expires:      opts.Expires,
+		MaxDownloads: opts.MaxDownloads,
+		PasswordHash: opts.PasswordHash,
+		Private:      opts.Private,
+	}
+
+	err = cdnMetadata.SavePendingUpload(ctx, &PendingUpload{
+		Key:         file.ID,
+		FileName:    name,
+		Size:        -1,
+		ContentType: file.ContentType,
+		Options:     opts,
+		Created:     file.Uploaded,
+		Expires:     file.Uploaded,
+	})
+	if err != nil {
+		return nil, NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	err = cdnStorage.Put(ctx, file.ID, reader, &PutOptions{
+		Size:        -1,
+		ContentType: file.ContentType,
+		Private:     opts.private(),
+	})
 	if err != nil {
-		return "", NewResponse(fiber.StatusInternalServerError, "Failed to get uploaded file.")
+		cdnMetadata.DeletePendingUpload(ctx, file.ID)
+		return nil, uploadReadError(err)
 	}
 
-	size := fileHeader.Size
-	buffer := make([]byte, size)
+	file.Size = int64(*size)
+	file.SHA256 = hex.EncodeToString(sha.Sum(nil))
+	file.MD5 = hex.EncodeToString(md.Sum(nil))
+
+	return file, nil
+}
+
+func uploadReadError(err error) *JSONResponse {
+	if errors.Is(err, errUploadTooLarge) {
+		return NewResponse(fiber.StatusRequestEntityTooLarge, fmt.Sprintf("File is larger than the %v bytes allowed.", cdnConfig.MaxUploadSize))
+	}
 
-	uploadedFile, err := fileHeader.Open()
+	return NewResponseByError(fiber.StatusInternalServerError, err)
+}
+
+// records an upload that's already stored, or hands out a file with the same contents instead.
+// the object is deleted again when it isn't kept
+func saveStoredUpload(ctx context.Context, file *File, opts *UploadOptions) (string, *JSONResponse) {
+	duplicate, err := findDuplicate(ctx, file.SHA256, file.Size, opts)
 	if err != nil {
-		return "", NewResponse(fiber.StatusInternalServerError, "Failed to open uploaded file.")
+		discardStoredUpload(ctx, file.ID)
+		return "", NewResponseByError(fiber.StatusInternalServerError, err)
+	} else if duplicate != nil {
+		discardStoredUpload(ctx, file.ID)
+		return duplicate.ID, nil
 	}
 
-	_, err = uploadedFile.Read(buffer)
+	if respErr := reserveQuota(ctx, opts.Owner, file.Size); respErr != nil {
+		discardStoredUpload(ctx, file.ID)
+		return "", respErr
+	}
+
+	if err := cdnMetadata.SaveFile(ctx, file); err != nil {
+		discardStoredUpload(ctx, file.ID)
+		releaseQuota(ctx, opts.Owner, file.Size, file.Uploaded)
+		return "", NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	if err := cdnMetadata.DeletePendingUpload(ctx, file.ID); err != nil {
+		log.Printf("Failed to delete completed upload %v: %v", file.ID, err)
+	}
+
+	return file.ID, nil
+}
+
+// deletes a streamed upload that isn't kept, the pending record only goes once the object is gone
+func discardStoredUpload(ctx context.Context, key string) {
+	if err := cdnStorage.Delete(ctx, key); err != nil && err != ErrObjectNotFound {
+		log.Printf("Failed to delete object of upload %v: %v", key, err)
+		return
+	}
+
+	if err := cdnMetadata.DeletePendingUpload(ctx, key); err != nil {
+		log.Printf("Failed to delete upload %v: %v", key, err)
+	}
+}
+
+// stores a fully received upload under a new random name and records it in the index.
+// when the same contents were already uploaded the name of that file is returned instead
+func SaveUpload(ctx context.Context, file io.ReadSeeker, name string, size int64, opts *UploadOptions) (string, *JSONResponse) {
+	contentType, err := sniffContentType(file)
 	if err != nil {
 		return "", NewResponse(fiber.StatusInternalServerError, "Failed to read uploaded file.")
 	}
 
-	uploadedFile.Close()
+	sha, md, err := hashFile(file)
+	if err != nil {
+		return "", NewResponse(fiber.StatusInternalServerError, "Failed to read uploaded file.")
+	}
 
-	fileName := randSeq(8) + filepath.Ext(fileHeader.Filename)
+	duplicate, err := findDuplicate(ctx, sha, size, opts)
+	if err != nil {
+		return "", NewResponseByError(fiber.StatusInternalServerError, err)
+	} else if duplicate != nil {
+		return duplicate.ID, nil
+	}
 
-	object := s3.PutObjectInput{
-		Bucket:               aws.String(cdnConfig.SpacesConfig.SpacesName),
-		Key:                  aws.String(fileName),
-		ACL:                  aws.String("public-read"),
-		Body:                 strings.NewReader(string(buffer)),
-		ContentLength:        aws.Int64(size),
-		ContentType:          aws.String(http.DetectContentType(buffer)),
-		ServerSideEncryption: aws.String("AES256"),
+	if respErr := reserveQuota(ctx, opts.Owner, size); respErr != nil {
+		return "", respErr
 	}
+	reserved := time.Now()
+
+	ext := filepath.Ext(name)
+	fileName := randSeq(8) + ext
 
-	_, err = s3.New(s).PutObject(&object)
+	err = cdnStorage.Put(ctx, fileName, file, &PutOptions{
+		Size:        size,
+		ContentType: contentType,
+		Private:     opts.private(),
+	})
 	if err != nil {
+		releaseQuota(ctx, opts.Owner, size, reserved)
+		return "", NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	err = cdnMetadata.SaveFile(ctx, &File{
+		ID:           fileName,
+		Ext:          ext,
+		Name:         name,
+		ContentType:  contentType,
+		Owner:        opts.Owner,
+		Size:         size,
+		SHA256:       sha,
+		MD5:          md,
+		Uploaded:     time.Now().UTC(),
+		Expires:      opts.Expires,
+		MaxDownloads: opts.MaxDownloads,
+		PasswordHash: opts.PasswordHash,
+		Private:      opts.Private,
+	})
+	if err != nil {
+		// a file missing from the index would never be listed, so don't keep it
+		cdnStorage.Delete(ctx, fileName)
+		releaseQuota(ctx, opts.Owner, size, reserved)
 		return "", NewResponseByError(fiber.StatusInternalServerError, err)
 	}
 
 	return fileName, nil
 }
 
-// func CheckOwner(s *session.Session, file, owner string) *JSONResponse {
-// 	object := s3.HeadObjectInput{
-// 		Bucket: aws.String(cdnConfig.SpacesConfig.SpacesName),
-// 		Key:    aws.String(file),
-// 	}
+// finds a file with the same contents that can be handed out in place of a new upload,
+// files with any options are never shared as the options of one would apply to both
+func findDuplicate(ctx context.Context, sha string, size int64, opts *UploadOptions) (*File, error) {
+	if !opts.plain() {
+		return nil, nil
+	}
 
-// 	out, err := s3.New(s).HeadObject(&object)
-// 	if err != nil {
-// 		return NewResponseByError(fiber.StatusInternalServerError, err)
-// 	}
+	files, err := cdnMetadata.FindFilesByHash(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
 
-// 	if *out.Metadata["Owner"] != owner {
-// 		return NewResponse(fiber.StatusForbidden, "Cannot delete file not owned.")
-// 	}
+	for _, file := range files {
+		if file.Owner != opts.Owner || file.Size != size || file.Deleted != nil || file.Expires != nil || file.proxied() || file.expired() {
+			continue
+		}
 
-// 	return nil
-// }
+		// the record could be left over from an object that's gone
+		if _, err := cdnStorage.Head(ctx, file.ID); err == ErrObjectNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
 
-func DeleteFile(s *session.Session, file string) *JSONResponse {
-	object := &s3.DeleteObjectInput{
-		Bucket: aws.String(cdnConfig.SpacesConfig.SpacesName),
-		Key:    aws.String(file),
+		return file, nil
 	}
 
-	_, err := s3.New(s).DeleteObject(object)
+	return nil, nil
+}
+
+// hashes the whole file with sha256 and md5 and rewinds it
+func hashFile(file io.ReadSeeker) (string, string, error) {
+	sha, md, err := hashReader(file)
 	if err != nil {
-		return NewResponseByError(fiber.StatusInternalServerError, err)
+		return "", "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+
+	return sha, md, nil
+}
+
+// reads everything and returns the hex encoded sha256 and md5
+func hashReader(reader io.Reader) (string, string, error) {
+	sha, md := sha256.New(), md5.New()
+
+	if _, err := io.Copy(io.MultiWriter(sha, md), reader); err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(sha.Sum(nil)), hex.EncodeToString(md.Sum(nil)), nil
+}
+
+// the md5 of an object when its etag is one, which isn't the case for multipart uploads
+func etagMD5(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != md5.Size*2 {
+		return ""
+	}
+
+	if _, err := hex.DecodeString(etag); err != nil {
+		return ""
+	}
+
+	return etag
+}
+
+// detects the content type from the first 512 bytes and rewinds the file
+func sniffContentType(file io.ReadSeeker) (string, error) {
+	buffer := make([]byte, 512)
+
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(buffer[:n]), nil
+}
+
+func (file *File) CheckOwner(user *User) *JSONResponse {
+	if !user.owns(file.Owner) {
+		return NewResponse(fiber.StatusForbidden, "Cannot change file not owned.")
 	}
 
 	return nil
 }
 
-func GetFiles(s *session.Session) ([]*FileResult, error) {
-	var files []*FileResult
-	var shouldContinue = true
+// gets the record of a file, files uploaded before the index existed get an unsaved one
+func fileRecord(ctx context.Context, key string) (*File, *JSONResponse) {
+	file, err := cdnMetadata.GetFile(ctx, key)
+	if err == ErrRecordNotFound {
+		if pending, err := isPendingUpload(ctx, key); err != nil {
+			return nil, NewResponseByError(fiber.StatusInternalServerError, err)
+		} else if pending {
+			return nil, NewResponse(fiber.StatusNotFound, "File not found.")
+		}
+
+		file, err = importObject(ctx, key, false)
+		if err == ErrObjectNotFound {
+			return nil, NewResponse(fiber.StatusNotFound, "File not found.")
+		}
+	}
+
+	if err != nil {
+		return nil, NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	return file, nil
+}
+
+// moves the file to the trash, or purges it when the trash is turned off
+func DeleteFile(ctx context.Context, user *User, key string) ([]string, *JSONResponse) {
+	file, respErr := fileRecord(ctx, key)
+	if respErr != nil {
+		return nil, respErr
+	}
+
+	if respErr := file.CheckOwner(user); respErr != nil {
+		return nil, respErr
+	}
+
+	if trashEnabled() {
+		return nil, TrashFile(ctx, file)
+	}
+
+	return PurgeFile(ctx, key)
+}
+
+// deletes the file for good and removes it from every folder, returning the ids of those folders
+func PurgeFile(ctx context.Context, file string) ([]string, *JSONResponse) {
+	// the object may already be gone, the record still has to go with it
+	err := cdnStorage.Delete(ctx, file)
+	if err != nil && err != ErrObjectNotFound {
+		return nil, NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	record, err := cdnMetadata.DeleteFile(ctx, file)
+	if err != nil {
+		return nil, NewResponseByError(fiber.StatusInternalServerError, err)
+	} else if record != nil {
+		releaseFile(ctx, record)
+	}
+
+	folders, err := cdnMetadata.RemoveFileFromFolders(ctx, file)
+	if err != nil {
+		return nil, NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	return folders, nil
+}
+
+const defaultFilesLimit = 100
+const maxFilesLimit = 1000
+
+// checks the query and fills in the defaults
+func (query *FilesQuery) Validate() *JSONResponse {
+	if query.Limit == 0 {
+		query.Limit = defaultFilesLimit
+	} else if query.Limit < 0 || query.Limit > maxFilesLimit {
+		return NewResponse(fiber.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %v.", maxFilesLimit))
+	}
+
+	switch query.Sort {
+	case "":
+		query.Sort = "name"
+	case "name", "size", "last_modified":
+	default:
+		return NewResponse(fiber.StatusBadRequest, "Sort must be name, size or last_modified.")
+	}
+
+	switch query.Order {
+	case "":
+		query.Order = "asc"
+	case "asc", "desc":
+	default:
+		return NewResponse(fiber.StatusBadRequest, "Order must be asc or desc.")
+	}
+
+	var err error
+	if query.After != "" {
+		if query.after, err = time.Parse(time.RFC3339, query.After); err != nil {
+			return NewResponse(fiber.StatusBadRequest, "After must be an RFC 3339 date.")
+		}
+	}
+
+	if query.Before != "" {
+		if query.before, err = time.Parse(time.RFC3339, query.Before); err != nil {
+			return NewResponse(fiber.StatusBadRequest, "Before must be an RFC 3339 date.")
+		}
+	}
+
+	if query.Cursor != "" {
+		if query.cursor, err = decodeFileCursor(query.Cursor); err != nil {
+			return NewResponse(fiber.StatusBadRequest, "Invalid cursor.")
+		}
+	}
+
+	return nil
+}
+
+// lists a page of files from the index, the cursor is the position of the last file of the page.
+// the store pages by owner and prefix, everything else is filtered here a page at a time until the page is full
+func ListFiles(ctx context.Context, query *FilesQuery) (*FilesResult, error) {
+	page := &FilesPageQuery{
+		Owner:      query.Owner,
+		Prefix:     query.Prefix,
+		Sort:       query.Sort,
+		Descending: query.Order == "desc",
+		After:      query.cursor,
+		Limit:      query.Limit + 1,
+	}
+
+	// one more than the limit is looked for to know whether there's another page
+	var files []*File
+	for len(files) <= query.Limit {
+		batch, err := cdnMetadata.ListFilesPage(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range batch {
+			if query.matches(file) {
+				files = append(files, file)
+			}
+
+			page.After = file.cursor()
+		}
+
+		if len(batch) < page.Limit {
+			break
+		}
+	}
+
+	nextCursor := ""
+	if len(files) > query.Limit {
+		files = files[:query.Limit]
+		nextCursor = encodeFileCursor(files[len(files)-1].cursor())
+	}
+
+	results := make([]*FileResult, len(files))
+	for i, file := range files {
+		results[i] = NewFileResultFromRecord(file)
+	}
+
+	return &FilesResult{
+		Files:      results,
+		Length:     len(results),
+		NextCursor: nextCursor,
+	}, nil
+}
+
+func (file *File) cursor() *FileCursor {
+	return &FileCursor{
+		ID:       file.ID,
+		Size:     file.Size,
+		Uploaded: file.Uploaded,
+	}
+}
+
+func encodeFileCursor(cursor *FileCursor) string {
+	return base64.RawURLEncoding.EncodeToString(toJSON(cursor))
+}
+
+func decodeFileCursor(encoded string) (*FileCursor, error) {
+	body, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := new(FileCursor)
+	if err := json.Unmarshal(body, cursor); err != nil {
+		return nil, err
+	}
+
+	if cursor.ID == "" {
+		return nil, errors.New("cursor without an id")
+	}
+
+	return cursor, nil
+}
+
+// lists every object in storage starting with the prefix
+func listObjects(ctx context.Context, prefix string) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
 	var nextToken = ""
 
-	for shouldContinue {
-		objects, err := s3.New(s).ListObjectsV2(&s3.ListObjectsV2Input{
-			Bucket:            aws.String(cdnConfig.SpacesConfig.SpacesName),
-			ContinuationToken: aws.String(nextToken),
-		})
+	for {
+		page, err := cdnStorage.List(ctx, &ListOptions{Prefix: prefix, Token: nextToken})
 		if err != nil {
 			return nil, err
 		}
 
-		var data []*FileResult
-		for _, obj := range objects.Contents {
-			data = append(data, &FileResult{
-				CdnUrl:       fmt.Sprintf("%v/%v", cdnConfig.CdnEndpoint, *obj.Key),
-				SpacesUrl:    fmt.Sprintf("%v/%v", cdnConfig.SpacesConfig.SpacesUrl, *obj.Key),
-				SpacesCdn:    fmt.Sprintf("%v/%v", cdnConfig.SpacesConfig.SpacesCdn, *obj.Key),
-				FileName:     *obj.Key,
-				LastModified: *obj.LastModified,
-				Size:         *obj.Size,
-			})
+		objects = append(objects, page.Objects...)
+
+		if page.NextToken == "" {
+			break
+		}
+
+		nextToken = page.NextToken
+	}
+
+	return objects, nil
+}
+
+// whether the file is listed for the query
+func (query *FilesQuery) matches(file *File) bool {
+	if query.Owner != "" && file.Owner != query.Owner {
+		return false
+	}
+
+	if file.Deleted != nil || file.expired() || !strings.HasPrefix(file.ID, query.Prefix) || !strings.HasPrefix(file.ContentType, query.Type) {
+		return false
+	}
+
+	if !query.after.IsZero() && file.Uploaded.Before(query.after) {
+		return false
+	}
+
+	return query.before.IsZero() || file.Uploaded.Before(query.before)
+}
+
+// how many files of a folder are looked up at the same time
+const folderLookupConcurrency = 8
+
+// looks up the files in parallel, keeping them in the same order as the keys.
+// files that no longer exist are marked as missing, files in the trash as trashed and
+// expired files as expired instead of failing the whole lookup. files not owned by the owner
+// only get what anyone may see of them
+func GetFilesByKeys(ctx context.Context, keys []string, owner string) ([]*FileResult, error) {
+	files := make([]*FileResult, len(keys))
+
+	err := parallel(ctx, len(keys), folderLookupConcurrency, func(ctx context.Context, index int) error {
+		file, err := fileAvailable(ctx, keys[index])
+		switch err {
+		case nil:
+		case ErrObjectNotFound:
+			files[index] = MissingFileResult(keys[index])
+			files[index].Status = "trashed"
+			return nil
+		case ErrFileExpired:
+			files[index] = MissingFileResult(keys[index])
+			files[index].Status = "expired"
+			return nil
+		case ErrRecordNotFound:
+			files[index] = MissingFileResult(keys[index])
+			return nil
+		default:
+			return err
+		}
+
+		obj, err := cdnStorage.Head(ctx, keys[index])
+		if err == ErrObjectNotFound {
+			files[index] = MissingFileResult(keys[index])
+			return nil
+		} else if err != nil {
+			return err
 		}
 
-		files = append(files, data...)
-		if !*objects.IsTruncated {
-			shouldContinue = false
-			nextToken = ""
+		if file != nil && file.Owner != owner {
+			files[index] = ForeignFileResult(file)
+		} else if file != nil {
+			files[index] = NewFileResultFromRecord(file)
 		} else {
-			nextToken = *objects.NextContinuationToken
+			files[index] = NewFileResult(obj)
 		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return files, nil
 }
 
-func GetFilesByKeys(s *session.Session, keys []string) ([]*FileResult, error) {
-	var files []*FileResult
-	var client = s3.New(s)
+func NewFileResult(obj *ObjectInfo) *FileResult {
+	return &FileResult{
+		CdnUrl:       fmt.Sprintf("%v/%v", cdnConfig.CdnEndpoint, obj.Key),
+		SpacesUrl:    cdnStorage.PublicURL(obj.Key),
+		SpacesCdn:    spacesCdnURL(obj.Key),
+		FileName:     obj.Key,
+		ContentType:  obj.ContentType,
+		LastModified: obj.LastModified,
+		Size:         obj.Size,
+	}
+}
 
-	for _, key := range keys {
-		obj, err := client.HeadObject(&s3.HeadObjectInput{
-			Bucket: &cdnConfig.SpacesConfig.SpacesName,
-			Key:    &key,
-		})
+func NewFileResultFromRecord(file *File) *FileResult {
+	result := &FileResult{
+		CdnUrl:       fmt.Sprintf("%v/%v", cdnConfig.CdnEndpoint, file.ID),
+		FileName:     file.ID,
+		Name:         file.Name,
+		Owner:        file.Owner,
+		ContentType:  file.ContentType,
+		LastModified: file.Uploaded,
+		Size:         file.Size,
+		Deleted:      file.Deleted,
+		Expires:      file.Expires,
+		MaxDownloads: file.MaxDownloads,
+		Downloads:    file.Downloads,
+		Protected:    file.PasswordHash != "",
+		Private:      file.Private,
+	}
 
-		if err != nil {
+	if !file.proxied() {
+		result.SpacesUrl = cdnStorage.PublicURL(file.ID)
+		result.SpacesCdn = spacesCdnURL(file.ID)
+	}
+
+	return result
+}
+
+// whether the file expired or has no downloads left
+func (file *File) expired() bool {
+	if file.MaxDownloads > 0 && file.Downloads >= file.MaxDownloads {
+		return true
+	}
+
+	return file.Expires != nil && !time.Now().Before(*file.Expires)
+}
+
+// whether the file can only be served through the cdn and never straight from its public url
+func (file *File) proxied() bool {
+	return file.Private || file.MaxDownloads > 0 || file.PasswordHash != ""
+}
+
+// checks the index for whether the file can be served and returns its record,
+// files the index doesn't know about can be served but have no record.
+// files in the trash are treated as not found and expired files give ErrFileExpired.
+// uploads that aren't completed give ErrRecordNotFound as none of their options apply yet
+func fileAvailable(ctx context.Context, key string) (*File, error) {
+	file, err := cdnMetadata.GetFile(ctx, key)
+	if err == ErrRecordNotFound {
+		if pending, err := isPendingUpload(ctx, key); err != nil {
 			return nil, err
+		} else if pending {
+			return nil, ErrRecordNotFound
 		}
 
-		files = append(files, &FileResult{
-			CdnUrl:       fmt.Sprintf("%v/%v", cdnConfig.CdnEndpoint, key),
-			SpacesUrl:    fmt.Sprintf("%v/%v", cdnConfig.SpacesConfig.SpacesUrl, key),
-			SpacesCdn:    fmt.Sprintf("%v/%v", cdnConfig.SpacesConfig.SpacesCdn, key),
-			FileName:     key,
-			LastModified: *obj.LastModified,
-			Size:         *obj.ContentLength,
-		})
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
 
-	return files, nil
+	if file.Deleted != nil {
+		return nil, ErrObjectNotFound
+	}
+
+	if file.expired() {
+		return nil, ErrFileExpired
+	}
+
+	return file, nil
+}
+
+// a file that is still referenced but no longer in storage
+// the result of a file in a folder of someone else, leaving out what only its owner should see
+func ForeignFileResult(file *File) *FileResult {
+	result := NewFileResultFromRecord(file)
+	result.Name = ""
+	result.Owner = ""
+	result.Expires = nil
+	result.MaxDownloads = 0
+	result.Downloads = 0
+	result.Private = false
+
+	return result
+}
+
+func MissingFileResult(key string) *FileResult {
+	return &FileResult{
+		CdnUrl:   fmt.Sprintf("%v/%v", cdnConfig.CdnEndpoint, key),
+		FileName: key,
+		Status:   "missing",
+	}
+}
+
+// the url of the file through the Spaces cdn, empty when it's not configured
+func spacesCdnURL(key string) string {
+	if cdnConfig.SpacesConfig.SpacesCdn == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%v/%v", cdnConfig.SpacesConfig.SpacesCdn, key)
 }
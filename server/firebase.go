@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// with FIREBASE_AUTH on, anyone signed in with Firebase Auth can use their ID token instead of a cdn token.
+// the first time an account is seen a user is created for it, with the firebase uid as its id
+
+// verifies a Firebase ID token and gets its user, creating one for new accounts
+func userForIDToken(ctx context.Context, idToken string) (*User, error) {
+	// the sdk verifies tokens of the emulator itself when FIREBASE_AUTH_EMULATOR_HOST is set
+	token, err := cdnAuth.VerifyIDToken(ctx, idToken)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	user, err := cdnMetadata.GetUser(ctx, token.UID)
+	if err != ErrRecordNotFound {
+		return user, err
+	}
+
+	user = &User{
+		UID:     token.UID,
+		Name:    tokenName(token),
+		Created: time.Now().UTC(),
+	}
+
+	if err := cdnMetadata.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created user %v for a new Firebase account", user.UID)
+	return user, nil
+}
+
+// the display name of the account, falling back to its email
+func tokenName(token *auth.Token) string {
+	for _, claim := range []string{"name", "email"} {
+		if value, ok := token.Claims[claim].(string); ok && value != "" {
+			return value
+		}
+	}
+
+	return token.UID
+}
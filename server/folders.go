@@ -2,12 +2,10 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"time"
 
-	"cloud.google.com/go/firestore"
 	"github.com/gofiber/fiber/v2"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 type Folder struct {
@@ -15,57 +13,49 @@ type Folder struct {
 	Data       *FolderData
 	CreateTime time.Time
 	UpdateTime time.Time
-	Updates    []firestore.Update
+	Updates    []Update
 }
 
 type FolderData struct {
 	ID    string   `json:"id"`
 	Name  string   `json:"name"`
+	Owner string   `json:"owner"`
 	Files []string `json:"files"`
+	// when the folder was moved to the trash
+	Deleted *time.Time `json:"deleted,omitempty"`
 }
 
 // creates a new folder
-func NewFolder(name string) (*Folder, *JSONResponse) {
-	firebaseCtx := context.Background()
-	folderID := randSeq(8)
+func NewFolder(ctx context.Context, name string, owner string) (*Folder, *JSONResponse) {
 	folderData := &FolderData{
-		ID:    folderID,
+		ID:    randSeq(8),
 		Name:  name,
+		Owner: owner,
 		Files: make([]string, 0),
 	}
 
-	doc, err := cdnFirestore.Collection("folders").Doc(folderID).Create(firebaseCtx, folderData)
+	folder, err := cdnMetadata.CreateFolder(ctx, folderData)
 	if err != nil {
 		return nil, NewResponseByError(fiber.StatusInternalServerError, err)
 	}
 
-	folder := new(Folder)
-	folder.CreateTime = doc.UpdateTime
-	folder.UpdateTime = doc.UpdateTime
-	folder.Data = folderData
-
 	return folder, nil
 }
 
-// gets a folder, optionally cache all files in it
-func FolderFor(id string) (*Folder, *JSONResponse) {
-	firebaseCtx := context.Background()
-	folder := new(Folder)
-
-	doc, err := cdnFirestore.Collection("folders").Doc(id).Get(firebaseCtx)
+// gets a folder, optionally cache all files in it. folders in the trash aren't found
+func FolderFor(ctx context.Context, id string) (*Folder, *JSONResponse) {
+	folder, err := cdnMetadata.GetFolder(ctx, id)
 	if err != nil {
-		if status.Code(err) == codes.NotFound {
+		if err == ErrRecordNotFound {
 			return nil, NewResponse(fiber.StatusNotFound, "Folder not found")
 		}
 
 		return nil, NewResponseByError(fiber.StatusInternalServerError, err)
 	}
 
-	folder.CreateTime = doc.UpdateTime
-	folder.UpdateTime = doc.UpdateTime
-
-	folder.Data = new(FolderData)
-	doc.DataTo(folder.Data)
+	if folder.Data.Deleted != nil {
+		return nil, NewResponse(fiber.StatusNotFound, "Folder not found")
+	}
 
 	return folder, nil
 }
@@ -78,7 +68,7 @@ func (folder *Folder) IsChanged() bool {
 func (folder *Folder) SetName(name string) {
 	folder.Data.Name = name
 
-	folder.Updates = append(folder.Updates, firestore.Update{
+	folder.Updates = append(folder.Updates, Update{
 		Path:  "Name",
 		Value: folder.Data.Name,
 	})
@@ -88,12 +78,33 @@ func (folder *Folder) SetName(name string) {
 func (folder *Folder) AddFiles(files []string, cacheFiles bool) {
 	folder.Data.Files = Set(append(folder.Data.Files, files...))
 
-	folder.Updates = append(folder.Updates, firestore.Update{
+	folder.Updates = append(folder.Updates, Update{
 		Path:  "Files",
-		Value: folder.Data.Files,
+		Value: files,
+		Op:    updateAdd,
 	})
 }
 
+// checks that the user owns every file that isn't in the folder yet
+func (folder *Folder) CheckFilesOwned(ctx context.Context, user *User, keys []string) *JSONResponse {
+	for _, key := range keys {
+		if indexOf(folder.Data.Files, key) != -1 {
+			continue
+		}
+
+		file, respErr := fileRecord(ctx, key)
+		if respErr != nil {
+			return respErr
+		}
+
+		if !user.owns(file.Owner) {
+			return NewResponse(fiber.StatusForbidden, "Cannot add file not owned.")
+		}
+	}
+
+	return nil
+}
+
 // a list of ids to remove
 func (folder *Folder) RemoveFiles(files []string) {
 	for _, file := range files {
@@ -102,23 +113,65 @@ func (folder *Folder) RemoveFiles(files []string) {
 		}
 	}
 
-	folder.Updates = append(folder.Updates, firestore.Update{
+	folder.Updates = append(folder.Updates, Update{
 		Path:  "Files",
-		Value: folder.Data.Files,
+		Value: files,
+		Op:    updateRemove,
 	})
 }
 
-// func (folder *Folder) CheckOwner(owner string) *JSONResponse {
-// 	if folder.Data.Owner != owner {
-// 		return NewResponse(fiber.StatusForbidden, "Cannot delete folder not owned.")
-// 	}
+// applies an update to the data, used by stores that can't change a single field themselves
+func (data *FolderData) apply(update Update) error {
+	switch update.Path {
+	case "Name":
+		data.Name, _ = update.Value.(string)
+	case "Deleted":
+		data.Deleted, _ = update.Value.(*time.Time)
+	case "Files":
+		files, _ := update.Value.([]string)
+
+		switch update.Op {
+		case updateAdd:
+			data.Files = Set(append(data.Files, files...))
+		case updateRemove:
+			kept := make([]string, 0, len(data.Files))
+			for _, file := range data.Files {
+				if indexOf(files, file) == -1 {
+					kept = append(kept, file)
+				}
+			}
+
+			data.Files = kept
+		default:
+			data.Files = files
+		}
+	default:
+		return fmt.Errorf("unknown folder field %v", update.Path)
+	}
+
+	return nil
+}
+
+func (folder *Folder) CheckOwner(user *User) *JSONResponse {
+	if !user.owns(folder.Data.Owner) {
+		return NewResponse(fiber.StatusForbidden, "Cannot change folder not owned.")
+	}
 
-// 	return nil
-// }
+	return nil
+}
+
+// moves the folder to the trash, or purges it when the trash is turned off
+func (folder *Folder) Delete(ctx context.Context) *JSONResponse {
+	if trashEnabled() {
+		return folder.Trash(ctx)
+	}
+
+	return folder.Purge(ctx)
+}
 
-func (folder *Folder) Delete() *JSONResponse {
-	firebaseCtx := context.Background()
-	_, err := cdnFirestore.Collection("folders").Doc(folder.Data.ID).Delete(firebaseCtx)
+// deletes the folder for good, the files in it are kept
+func (folder *Folder) Purge(ctx context.Context) *JSONResponse {
+	err := cdnMetadata.DeleteFolder(ctx, folder.Data.ID)
 
 	if err != nil {
 		return NewResponseByError(fiber.StatusInternalServerError, err)
@@ -140,14 +193,14 @@ func (folder *Folder) ToJSONMap() map[string]interface{} {
 	return folder.ToJSON().Map
 }
 
-func (folder *Folder) Save() *JSONResponse {
-	firebaseCtx := context.Background()
-	_, err := cdnFirestore.Collection("folders").Doc(folder.Data.ID).Update(firebaseCtx, folder.Updates)
+func (folder *Folder) Save(ctx context.Context) *JSONResponse {
+	err := cdnMetadata.UpdateFolder(ctx, folder)
 
 	if err != nil {
 		return NewResponseByError(fiber.StatusInternalServerError, err)
 	}
 
+	folder.Updates = nil
 	return nil
 }
 
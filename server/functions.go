@@ -1,34 +1,46 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func authorize(ctx *fiber.Ctx) error {
-	authorization := ctx.Get("Authorization")
-	if authorization == "" {
-		return fiber.NewError(fiber.StatusUnauthorized, "No authorization token provided.")
-	}
+// checks the request is authorized, api keys also need every one of the scopes
+func authorize(scopes ...string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		authorization := ctx.Get("Authorization")
+		if authorization == "" {
+			return fiber.NewError(fiber.StatusUnauthorized, "No authorization token provided.")
+		}
 
-	// _ctx := context.Background()
+		user, key, err := authenticate(ctx.Context(), authorization)
+		if err == errInvalidToken {
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid authorization token provided.")
+		} else if err == errUserDisabled {
+			return fiber.NewError(fiber.StatusForbidden, "User is disabled.")
+		} else if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
 
-	// token, err := cdnAuth.VerifyIDToken(_ctx, authorization)
-	// if err != nil {
-	// 	return fiber.NewError(fiber.StatusUnauthorized, "Invalid authorization token provided.")
-	// }
+		for _, scope := range scopes {
+			if key != nil && !key.HasScope(scope) {
+				return fiber.NewError(fiber.StatusForbidden, fmt.Sprintf("API key is missing the %v scope.", scope))
+			}
+		}
 
-	// ctx.Locals("user", token.UID)
+		// the uid is the firebase uid for users signed in with Firebase Auth
+		ctx.Locals("user", user)
+		ctx.Locals("uid", user.UID)
+		ctx.Locals("key", key)
 
-	if authorization != cdnConfig.Authorization {
-		return fiber.NewError(fiber.StatusUnauthorized, "No authorization token provided.")
+		return ctx.Next()
 	}
-
-	return ctx.Next()
 }
 
 func contains(values []string, value string) bool {
@@ -51,6 +63,53 @@ func indexOf(values []string, value string) int {
 	return -1
 }
 
+// calls fn for every index from 0 to count with at most concurrency calls running at once,
+// stopping at the first error
+func parallel(ctx context.Context, count int, concurrency int, fn func(ctx context.Context, index int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var firstErr error
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency && i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for index := range indexes {
+				if err := fn(ctx, index); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+send:
+	for index := 0; index < count; index++ {
+		select {
+		case indexes <- index:
+		case <-ctx.Done():
+			break send
+		}
+	}
+
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return ctx.Err()
+}
+
 func toJSON(s interface{}) []byte {
 	body, _ := json.Marshal(s)
 	return body
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// admins hand out invite codes so teammates can create their own user, each code works once
+
+// how long an invite lasts unless asked otherwise
+const defaultInviteExpiry = 7 * 24 * time.Hour
+
+// creates an invite, the code is returned as only its hash is stored
+func NewInvite(ctx context.Context, createdBy string, admin bool, expiry time.Duration) (*Invite, string, error) {
+	code, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+	invite := &Invite{
+		ID:        randSeq(8),
+		Hash:      hashToken(code),
+		Admin:     admin,
+		CreatedBy: createdBy,
+		Created:   now,
+		Expires:   now.Add(expiry).Truncate(time.Second),
+	}
+
+	if err := cdnMetadata.SaveInvite(ctx, invite); err != nil {
+		return nil, "", err
+	}
+
+	return invite, code, nil
+}
+
+func (invite *Invite) ToResult() *InviteResult {
+	return &InviteResult{
+		ID:        invite.ID,
+		Admin:     invite.Admin,
+		CreatedBy: invite.CreatedBy,
+		Created:   invite.Created,
+		Expires:   invite.Expires,
+	}
+}
+
+func createInviteRoute(ctx *fiber.Ctx) error {
+	body := new(InviteRequest)
+
+	if err := ctx.BodyParser(body); err != nil {
+		respErr := NewResponseByError(fiber.StatusBadRequest, err)
+		return ctx.JSON(respErr)
+	}
+
+	expiry := defaultInviteExpiry
+	if body.ExpiresIn < 0 {
+		respErr := NewResponse(fiber.StatusBadRequest, "Expires in must be a positive number of seconds.")
+		return ctx.JSON(respErr)
+	} else if body.ExpiresIn > 0 {
+		expiry = time.Duration(body.ExpiresIn) * time.Second
+	}
+
+	invite, code, err := NewInvite(ctx.Context(), currentUser(ctx).UID, body.Admin, expiry)
+	if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(&NewInviteResult{
+		Invite: invite.ToResult(),
+		Code:   code,
+	})
+}
+
+// lists the invites that haven't been used or expired yet
+func getInvitesRoute(ctx *fiber.Ctx) error {
+	invites, err := cdnMetadata.ListInvites(ctx.Context())
+	if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	now := time.Now()
+
+	results := make([]*InviteResult, 0, len(invites))
+	for _, invite := range invites {
+		if now.Before(invite.Expires) {
+			results = append(results, invite.ToResult())
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Created.Before(results[j].Created)
+	})
+
+	return ctx.JSON(results)
+}
+
+func revokeInviteRoute(ctx *fiber.Ctx) error {
+	id := ctx.Params("id")
+
+	if err := cdnMetadata.DeleteInvite(ctx.Context(), id); err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(fiber.Map{
+		"id":      id,
+		"success": true,
+		"code":    200,
+	})
+}
+
+// lets someone with an invite code create their own user
+func createUserRoute(ctx *fiber.Ctx) error {
+	body := new(RegisterRequest)
+
+	if err := ctx.BodyParser(body); err != nil {
+		respErr := NewResponseByError(fiber.StatusBadRequest, err)
+		return ctx.JSON(respErr)
+	}
+
+	if body.Name == "" {
+		respErr := NewResponse(fiber.StatusBadRequest, "User name required.")
+		return ctx.JSON(respErr)
+	}
+
+	if body.Invite == "" {
+		respErr := NewResponse(fiber.StatusBadRequest, "Invite code required.")
+		return ctx.JSON(respErr)
+	}
+
+	invite, err := cdnMetadata.UseInvite(ctx.Context(), hashToken(body.Invite))
+	if err != nil && err != ErrRecordNotFound {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	if invite == nil || !time.Now().Before(invite.Expires) {
+		respErr := NewResponse(fiber.StatusForbidden, "Invalid or expired invite code.")
+		return ctx.JSON(respErr)
+	}
+
+	user, token, err := NewUser(ctx.Context(), body.Name, invite.Admin)
+	if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(&NewUserResult{
+		User:  user.ToResult(),
+		Token: token,
+	})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// api keys act for their owner with only some of the scopes, so a tool can be given a key that can only upload.
+// tokens of users, Firebase ID tokens and AUTHORIZATION have every scope
+
+const (
+	scopeUpload       = "upload"
+	scopeRead         = "read"
+	scopeDelete       = "delete"
+	scopeFoldersWrite = "folders:write"
+	// manages api keys, and for admins lets the key see and change everything
+	scopeAdmin = "admin"
+)
+
+var allScopes = []string{scopeUpload, scopeRead, scopeDelete, scopeFoldersWrite, scopeAdmin}
+
+// keys are marked as used at most this often so every request doesn't write to the store
+const keyUsedInterval = time.Minute
+
+// creates a key for the owner, the key itself is returned as only its hash is stored
+func NewAPIKey(ctx context.Context, owner string, label string, scopes []string, expires *time.Time) (*APIKey, string, *JSONResponse) {
+	if label == "" {
+		return nil, "", NewResponse(fiber.StatusBadRequest, "Key label required.")
+	}
+
+	if len(scopes) == 0 {
+		return nil, "", NewResponse(fiber.StatusBadRequest, "At least one scope is required.")
+	}
+
+	for _, scope := range scopes {
+		if !contains(allScopes, scope) {
+			return nil, "", NewResponse(fiber.StatusBadRequest, fmt.Sprintf("Unknown scope %v, must be one of %v.", scope, strings.Join(allScopes, ", ")))
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return nil, "", NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	token = "cdn_" + token
+
+	key := &APIKey{
+		ID:      randSeq(8),
+		Label:   label,
+		Owner:   owner,
+		Scopes:  scopes,
+		Hash:    hashToken(token),
+		Created: time.Now().UTC(),
+		Expires: expires,
+	}
+
+	if err := cdnMetadata.SaveKey(ctx, key); err != nil {
+		return nil, "", NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	return key, token, nil
+}
+
+// gets the user a key acts for, keys without the admin scope don't get the admin rights of their owner
+func userForKey(ctx context.Context, key *APIKey) (*User, error) {
+	if key.Expires != nil && !time.Now().Before(*key.Expires) {
+		return nil, errInvalidToken
+	}
+
+	user := adminUser
+	if key.Owner != adminUID {
+		var err error
+		user, err = cdnMetadata.GetUser(ctx, key.Owner)
+		if err == ErrRecordNotFound {
+			return nil, errInvalidToken
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if user.Admin && !key.HasScope(scopeAdmin) {
+		limited := *user
+		limited.Admin = false
+		user = &limited
+	}
+
+	if key.LastUsed == nil || time.Since(*key.LastUsed) > keyUsedInterval {
+		if err := cdnMetadata.MarkKeyUsed(ctx, key.ID, time.Now().UTC()); err != nil {
+			log.Printf("Failed to mark key %v as used: %v", key.ID, err)
+		}
+	}
+
+	return user, nil
+}
+
+func (key *APIKey) HasScope(scope string) bool {
+	return contains(key.Scopes, scope)
+}
+
+func (key *APIKey) ToResult() *APIKeyResult {
+	return &APIKeyResult{
+		ID:       key.ID,
+		Label:    key.Label,
+		Owner:    key.Owner,
+		Scopes:   key.Scopes,
+		Created:  key.Created,
+		Expires:  key.Expires,
+		LastUsed: key.LastUsed,
+	}
+}
+
+// the api key the request was authorized with, nil when it wasn't one
+func currentKey(ctx *fiber.Ctx) *APIKey {
+	key, _ := ctx.Locals("key").(*APIKey)
+	return key
+}
+
+func createKeyRoute(ctx *fiber.Ctx) error {
+	body := new(APIKeyRequest)
+
+	if err := ctx.BodyParser(body); err != nil {
+		respErr := NewResponseByError(fiber.StatusBadRequest, err)
+		return ctx.JSON(respErr)
+	}
+
+	var expires *time.Time
+	if body.ExpiresIn < 0 {
+		respErr := NewResponse(fiber.StatusBadRequest, "Expires in must be a positive number of seconds.")
+		return ctx.JSON(respErr)
+	} else if body.ExpiresIn > 0 {
+		at := time.Now().Add(time.Duration(body.ExpiresIn) * time.Second).UTC().Truncate(time.Second)
+		expires = &at
+	}
+
+	// a key can't make a key that can do more than itself
+	if current := currentKey(ctx); current != nil {
+		for _, scope := range body.Scopes {
+			if !current.HasScope(scope) {
+				respErr := NewResponse(fiber.StatusForbidden, fmt.Sprintf("Cannot give a new key the %v scope this key doesn't have.", scope))
+				return ctx.JSON(respErr)
+			}
+		}
+	}
+
+	key, token, respErr := NewAPIKey(ctx.Context(), currentUser(ctx).UID, body.Label, body.Scopes, expires)
+	if respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(&NewAPIKeyResult{
+		Key:   key.ToResult(),
+		Token: token,
+	})
+}
+
+// lists the keys of the user, admins get every key
+func getKeysRoute(ctx *fiber.Ctx) error {
+	keys, err := cdnMetadata.ListKeys(ctx.Context())
+	if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	user := currentUser(ctx)
+
+	results := make([]*APIKeyResult, 0, len(keys))
+	for _, key := range keys {
+		if user.owns(key.Owner) {
+			results = append(results, key.ToResult())
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Created.Before(results[j].Created)
+	})
+
+	return ctx.JSON(results)
+}
+
+func revokeKeyRoute(ctx *fiber.Ctx) error {
+	id := ctx.Params("id")
+
+	key, err := cdnMetadata.GetKey(ctx.Context(), id)
+	if err == ErrRecordNotFound {
+		respErr := NewResponse(fiber.StatusNotFound, "Key not found.")
+		return ctx.JSON(respErr)
+	} else if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	if !currentUser(ctx).owns(key.Owner) {
+		respErr := NewResponse(fiber.StatusForbidden, "Cannot revoke key not owned.")
+		return ctx.JSON(respErr)
+	}
+
+	if err := cdnMetadata.DeleteKey(ctx.Context(), id); err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(fiber.Map{
+		"id":      id,
+		"success": true,
+		"code":    200,
+	})
+}
+
+// manages api keys from the command line, which is how the first key is made without AUTHORIZATION
+func keysCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: cdn keys list | create -label <label> -scopes <scopes> [-owner <id>] [-expires-in <seconds>] | revoke <id>")
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "list":
+		keys, err := cdnMetadata.ListKeys(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].Created.Before(keys[j].Created)
+		})
+
+		for _, key := range keys {
+			lastUsed := "never"
+			if key.LastUsed != nil {
+				lastUsed = key.LastUsed.Format(time.RFC3339)
+			}
+
+			fmt.Printf("%v\t%v\towner=%v\tscopes=%v\tlast used %v\n", key.ID, key.Label, key.Owner, strings.Join(key.Scopes, ","), lastUsed)
+		}
+	case "create":
+		flags := flag.NewFlagSet("keys create", flag.ExitOnError)
+		label := flags.String("label", "", "what the key is for")
+		scopes := flags.String("scopes", "", "comma separated scopes, any of "+strings.Join(allScopes, ", "))
+		owner := flags.String("owner", adminUID, "the id of the user the key acts for")
+		expiresIn := flags.Int64("expires-in", 0, "how many seconds the key lasts, 0 never expires")
+		flags.Parse(args[1:])
+
+		if *owner != adminUID {
+			if _, err := cdnMetadata.GetUser(ctx, *owner); err != nil {
+				log.Fatalf("Unknown user %v", *owner)
+			}
+		}
+
+		var expires *time.Time
+		if *expiresIn > 0 {
+			at := time.Now().Add(time.Duration(*expiresIn) * time.Second).UTC().Truncate(time.Second)
+			expires = &at
+		}
+
+		var scopeList []string
+		if *scopes != "" {
+			scopeList = strings.Split(*scopes, ",")
+		}
+
+		key, token, respErr := NewAPIKey(ctx, *owner, *label, scopeList, expires)
+		if respErr != nil {
+			log.Fatal(respErr.Message)
+		}
+
+		fmt.Printf("Created key %v: %v\n", key.ID, token)
+	case "revoke":
+		if len(args) < 2 {
+			log.Fatal("Usage: cdn keys revoke <id>")
+		}
+
+		if _, err := cdnMetadata.GetKey(ctx, args[1]); err != nil {
+			log.Fatalf("Unknown key %v", args[1])
+		}
+
+		if err := cdnMetadata.DeleteKey(ctx, args[1]); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Revoked key %v\n", args[1])
+	default:
+		log.Fatalf("Unknown keys command %v", args[0])
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// private files are only served with a signed link, which carries when it expires and a signature over the file and expiry
+
+const defaultLinkExpiry = time.Hour
+const maxLinkExpiry = 7 * 24 * time.Hour
+
+// how long the storage urls private files are redirected to can be used for
+const privateRedirectExpiry = 5 * time.Minute
+
+func signedFileURL(key string, expires time.Time) string {
+	value := strconv.FormatInt(expires.Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", value)
+	query.Set("signature", sign("file", key, value))
+
+	return fmt.Sprintf("%v/%v?%v", cdnConfig.CdnEndpoint, key, query.Encode())
+}
+
+// checks the expires and signature query parameters of a signed link
+func validFileLink(ctx *fiber.Ctx, key string) bool {
+	value := ctx.Query("expires")
+
+	expires, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return validSignature(ctx.Query("signature"), "file", key, value)
+}
+
+// redirects to a short lived storage url for the private file when the backend supports it,
+// anything that needs the cdn to see every request is streamed instead
+func sendPrivateFile(ctx *fiber.Ctx, file *File, info *ObjectInfo, attachment bool) error {
+	presigner, ok := unwrapStorage(cdnStorage).(PresignedStorage)
+	if !ok || attachment || file.MaxDownloads > 0 {
+		return sendFile(ctx, file, info, attachment)
+	}
+
+	url, err := presigner.PresignGet(file.ID, privateRedirectExpiry)
+	if err != nil {
+		return storageError(err)
+	}
+
+	ctx.Set("Cache-Control", "no-store")
+	return ctx.Redirect(url, fiber.StatusFound)
+}
+
+func createFileLinkRoute(ctx *fiber.Ctx) error {
+	key := ctx.Params("id")
+	body := new(FileLinkRequest)
+
+	if err := ctx.BodyParser(body); err != nil {
+		respErr := NewResponseByError(fiber.StatusBadRequest, err)
+		return ctx.JSON(respErr)
+	}
+
+	expiry := defaultLinkExpiry
+	if body.ExpiresIn != 0 {
+		expiry = time.Duration(body.ExpiresIn) * time.Second
+	}
+
+	if expiry <= 0 || expiry > maxLinkExpiry {
+		respErr := NewResponse(fiber.StatusBadRequest, fmt.Sprintf("Expires in must be between 1 and %v seconds.", int64(maxLinkExpiry.Seconds())))
+		return ctx.JSON(respErr)
+	}
+
+	file, err := fileAvailable(ctx.Context(), key)
+	if err != nil {
+		return storageError(err)
+	}
+
+	// files the index doesn't know about have no owner
+	owner := ""
+	if file != nil {
+		owner = file.Owner
+	}
+
+	if !currentUser(ctx).owns(owner) {
+		respErr := NewResponse(fiber.StatusForbidden, "Cannot change file not owned.")
+		return ctx.JSON(respErr)
+	}
+
+	if _, err := cdnStorage.Head(ctx.Context(), key); err != nil {
+		return storageError(err)
+	}
+
+	expires := time.Now().Add(expiry).Truncate(time.Second)
+
+	return ctx.JSON(&FileLinkResult{
+		Url:       signedFileURL(key, expires),
+		ExpiresAt: expires.UTC(),
+		Success:   true,
+		Code:      200,
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrRecordNotFound = errors.New("record not found")
+
+// a store for everything the cdn knows about besides the file contents
+type MetadataStore interface {
+	CreateFolder(ctx context.Context, data *FolderData) (*Folder, error)
+	GetFolder(ctx context.Context, id string) (*Folder, error)
+	ListFolders(ctx context.Context) ([]*Folder, error)
+	// lists the folders moved to the trash before the time, most recently deleted first
+	ListTrashedFolders(ctx context.Context, before time.Time) ([]*Folder, error)
+	// saves the pending updates of the folder and sets its update time
+	UpdateFolder(ctx context.Context, folder *Folder) error
+	DeleteFolder(ctx context.Context, id string) error
+	// removes the file from every folder in one transaction, returning the ids of the folders it was in
+	RemoveFileFromFolders(ctx context.Context, key string) ([]string, error)
+
+	// saves the user, replacing any user with the same id
+	SaveUser(ctx context.Context, user *User) error
+	GetUser(ctx context.Context, uid string) (*User, error)
+	// finds the user by the hash of their token
+	GetUserByToken(ctx context.Context, token string) (*User, error)
+	ListUsers(ctx context.Context) ([]*User, error)
+	DeleteUser(ctx context.Context, uid string) error
+
+	SaveInvite(ctx context.Context, invite *Invite) error
+	ListInvites(ctx context.Context) ([]*Invite, error)
+	DeleteInvite(ctx context.Context, id string) error
+	// finds the invite by the hash of its code and deletes it in one transaction, so it can only be used once
+	UseInvite(ctx context.Context, hash string) (*Invite, error)
+
+	// saves the api key, replacing any key with the same id
+	SaveKey(ctx context.Context, key *APIKey) error
+	GetKey(ctx context.Context, id string) (*APIKey, error)
+	// finds the key by its hash
+	GetKeyByHash(ctx context.Context, hash string) (*APIKey, error)
+	ListKeys(ctx context.Context) ([]*APIKey, error)
+	DeleteKey(ctx context.Context, id string) error
+	// sets when the key was last used, doing nothing when it was deleted in the meantime
+	MarkKeyUsed(ctx context.Context, id string, at time.Time) error
+
+	// saves an upload that was presigned but not completed yet
+	SavePendingUpload(ctx context.Context, upload *PendingUpload) error
+	GetPendingUpload(ctx context.Context, key string) (*PendingUpload, error)
+	ListPendingUploads(ctx context.Context) ([]*PendingUpload, error)
+	DeletePendingUpload(ctx context.Context, key string) error
+
+	// saves the record of a file, replacing any record with the same id
+	SaveFile(ctx context.Context, file *File) error
+	GetFile(ctx context.Context, id string) (*File, error)
+	ListFiles(ctx context.Context) ([]*File, error)
+	// lists files in the order of the query starting after its cursor, fewer than the limit are only
+	// returned when there are no more. files can still have to be filtered by prefix
+	ListFilesPage(ctx context.Context, query *FilesPageQuery) ([]*File, error)
+	// finds every file with the sha256 hash
+	FindFilesByHash(ctx context.Context, sha256 string) ([]*File, error)
+	// deletes the record of a file and returns it, nil when there was none. only one of several
+	// concurrent deletes gets the record, so its usage is only given back once
+	DeleteFile(ctx context.Context, id string) (*File, error)
+	// lists up to the limit of the files that expire at or before the time, soonest first
+	ListExpiredFiles(ctx context.Context, before time.Time, limit int) ([]*File, error)
+	// lists the files moved to the trash before the time, most recently deleted first
+	ListTrashedFiles(ctx context.Context, before time.Time) ([]*File, error)
+	// counts a download of a file with a download limit in one transaction, returning ErrFileExpired
+	// instead when the limit was already reached. the last download also makes the file expire
+	CountDownload(ctx context.Context, id string) (*File, error)
+
+	// gets the usage counters of the user, ErrRecordNotFound when they were never counted
+	GetUsage(ctx context.Context, uid string) (*Usage, error)
+	// saves the first counters of the user, doing nothing when they were saved in the meantime
+	InitUsage(ctx context.Context, uid string, usage *Usage) error
+	// changes the counters of the user in one transaction, nothing is saved when change returns an error
+	UpdateUsage(ctx context.Context, uid string, change func(usage *Usage) error) (*Usage, error)
+
+	Close() error
+}
+
+// a change to a single field of a record
+type Update struct {
+	Path  string
+	Value interface{}
+	// how the value is applied, lists are changed item by item so concurrent changes aren't lost
+	Op UpdateOp
+}
+
+type UpdateOp int
+
+const (
+	// replaces the field with the value
+	updateSet UpdateOp = iota
+	// adds the ids in the value to the list that aren't in it yet
+	updateAdd
+	// removes the ids in the value from the list
+	updateRemove
+)
+
+// what a store needs to list a page of files
+type FilesPageQuery struct {
+	Owner  string
+	Prefix string
+	// name, size or last_modified, ties are ordered by id
+	Sort       string
+	Descending bool
+	// the position of the last file of the previous page, nil for the first page
+	After *FileCursor
+	Limit int
+}
+
+// the position of a file in any of the orders it can be listed in
+type FileCursor struct {
+	ID       string    `json:"id"`
+	Size     int64     `json:"size,omitempty"`
+	Uploaded time.Time `json:"uploaded,omitempty"`
+}
+
+// creates the metadata store chosen in the config
+func NewMetadataStore(config *Config) (MetadataStore, error) {
+	switch config.MetadataDriver {
+	case "", "bolt":
+		return NewBoltStore(config.MetadataPath)
+	case "firestore":
+		return NewFirestoreStore(cdnFirestore), nil
+	}
+
+	return nil, fmt.Errorf("unknown metadata driver %q", config.MetadataDriver)
+}
@@ -0,0 +1,1202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var foldersBucket = []byte("folders")
+var filesBucket = []byte("files")
+
+var usersBucket = []byte("users")
+var keysBucket = []byte("keys")
+var invitesBucket = []byte("invites")
+var uploadsBucket = []byte("uploads")
+var usageBucket = []byte("usage")
+
+// token hashes of users pointing at their id
+var tokensBucket = []byte("tokens")
+
+// hashes of api keys pointing at their id
+var keyHashesBucket = []byte("key_hashes")
+
+// keys are the sha256 of a file followed by its id so every file with the same contents can be found
+var hashesBucket = []byte("hashes")
+
+// keys are the size or upload time of a file followed by its id so files can be paged through in that order
+var sizesBucket = []byte("files_by_size")
+var uploadedBucket = []byte("files_by_uploaded")
+
+// keys are the expiry of a file followed by its id, files that don't expire aren't in it
+var expiresBucket = []byte("files_by_expiry")
+
+// keys are when a file or folder was moved to the trash followed by its id, only what's in the trash is in them
+var deletedFilesBucket = []byte("files_by_deleted")
+var deletedFoldersBucket = []byte("folders_by_deleted")
+
+// keeps metadata in a single embedded database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+type boltFolder struct {
+	Data       *FolderData `json:"data"`
+	CreateTime time.Time   `json:"create_time"`
+	UpdateTime time.Time   `json:"update_time"`
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	if path == "" {
+		path = "cdn.db"
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{foldersBucket, filesBucket, usersBucket, tokensBucket, keysBucket, keyHashesBucket, invitesBucket, uploadsBucket, usageBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		// databases from before the trash index need it built from the existing folders
+		if tx.Bucket(deletedFoldersBucket) == nil {
+			if _, err := tx.CreateBucket(deletedFoldersBucket); err != nil {
+				return err
+			}
+
+			err := tx.Bucket(foldersBucket).ForEach(func(key, value []byte) error {
+				record := new(boltFolder)
+				if err := json.Unmarshal(value, record); err != nil {
+					return err
+				}
+
+				return putFolderIndex(tx, record.Data)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		indexes := [][]byte{hashesBucket, sizesBucket, uploadedBucket, expiresBucket, deletedFilesBucket}
+
+		missing := false
+		for _, bucket := range indexes {
+			missing = missing || tx.Bucket(bucket) == nil
+		}
+
+		if !missing {
+			return nil
+		}
+
+		// databases from before the indexes need them built from the existing files
+		for _, bucket := range indexes {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(filesBucket).ForEach(func(key, value []byte) error {
+			file := new(File)
+			if err := json.Unmarshal(value, file); err != nil {
+				return err
+			}
+
+			return putFileIndexes(tx, file)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (store *BoltStore) CreateFolder(ctx context.Context, data *FolderData) (*Folder, error) {
+	now := time.Now().UTC()
+	record := &boltFolder{
+		Data:       data,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		if err := putFolderIndex(tx, data); err != nil {
+			return err
+		}
+
+		return tx.Bucket(foldersBucket).Put([]byte(data.ID), toJSON(record))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return record.toFolder(), nil
+}
+
+func (store *BoltStore) GetFolder(ctx context.Context, id string) (*Folder, error) {
+	record := new(boltFolder)
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(foldersBucket).Get([]byte(id))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		return json.Unmarshal(value, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return record.toFolder(), nil
+}
+
+func (store *BoltStore) ListFolders(ctx context.Context) ([]*Folder, error) {
+	var folders []*Folder
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(foldersBucket).ForEach(func(key, value []byte) error {
+			record := new(boltFolder)
+			if err := json.Unmarshal(value, record); err != nil {
+				return err
+			}
+
+			folders = append(folders, record.toFolder())
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return folders, nil
+}
+
+func (store *BoltStore) ListTrashedFolders(ctx context.Context, before time.Time) ([]*Folder, error) {
+	var folders []*Folder
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(foldersBucket)
+
+		return listDeleted(tx.Bucket(deletedFoldersBucket), before, func(id []byte) error {
+			value := records.Get(id)
+			if value == nil {
+				return nil
+			}
+
+			record := new(boltFolder)
+			if err := json.Unmarshal(value, record); err != nil {
+				return err
+			}
+
+			folders = append(folders, record.toFolder())
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return folders, nil
+}
+
+// the folder data already holds every change so the whole record is rewritten
+func (store *BoltStore) UpdateFolder(ctx context.Context, folder *Folder) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(foldersBucket)
+		value := bucket.Get([]byte(folder.Data.ID))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		record := new(boltFolder)
+		if err := json.Unmarshal(value, record); err != nil {
+			return err
+		}
+
+		if err := removeFolderIndex(tx, record.Data); err != nil {
+			return err
+		}
+
+		// only the changes are applied so anything changed since the folder was read is kept
+		for _, update := range folder.Updates {
+			if err := record.Data.apply(update); err != nil {
+				return err
+			}
+		}
+
+		record.UpdateTime = time.Now().UTC()
+		folder.Data = record.Data
+		folder.UpdateTime = record.UpdateTime
+
+		if err := putFolderIndex(tx, record.Data); err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(folder.Data.ID), toJSON(record))
+	})
+}
+
+func (store *BoltStore) DeleteFolder(ctx context.Context, id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(foldersBucket)
+		value := bucket.Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+
+		record := new(boltFolder)
+		if err := json.Unmarshal(value, record); err != nil {
+			return err
+		}
+
+		if err := removeFolderIndex(tx, record.Data); err != nil {
+			return err
+		}
+
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (store *BoltStore) RemoveFileFromFolders(ctx context.Context, key string) ([]string, error) {
+	var ids []string
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(foldersBucket)
+		now := time.Now().UTC()
+
+		// collect the changes first as a bucket can't be written to while iterating it
+		changed := make(map[string]*boltFolder)
+
+		err := bucket.ForEach(func(id, value []byte) error {
+			record := new(boltFolder)
+			if err := json.Unmarshal(value, record); err != nil {
+				return err
+			}
+
+			if indexOf(record.Data.Files, key) == -1 {
+				return nil
+			}
+
+			files := make([]string, 0, len(record.Data.Files))
+			for _, file := range record.Data.Files {
+				if file != key {
+					files = append(files, file)
+				}
+			}
+
+			record.Data.Files = files
+			record.UpdateTime = now
+			changed[string(id)] = record
+			ids = append(ids, string(id))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for id, record := range changed {
+			if err := bucket.Put([]byte(id), toJSON(record)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (store *BoltStore) SaveUser(ctx context.Context, user *User) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		users, tokens := tx.Bucket(usersBucket), tx.Bucket(tokensBucket)
+
+		if value := users.Get([]byte(user.UID)); value != nil {
+			old := new(User)
+			if err := json.Unmarshal(value, old); err != nil {
+				return err
+			}
+
+			if old.Token != "" {
+				if err := tokens.Delete([]byte(old.Token)); err != nil {
+					return err
+				}
+			}
+		}
+
+		// users signing in with Firebase have no token of their own
+		if user.Token != "" {
+			if err := tokens.Put([]byte(user.Token), []byte(user.UID)); err != nil {
+				return err
+			}
+		}
+
+		return users.Put([]byte(user.UID), toJSON(user))
+	})
+}
+
+func (store *BoltStore) GetUser(ctx context.Context, uid string) (*User, error) {
+	user := new(User)
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(usersBucket).Get([]byte(uid))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		return json.Unmarshal(value, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (store *BoltStore) GetUserByToken(ctx context.Context, token string) (*User, error) {
+	var uid string
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(tokensBucket).Get([]byte(token))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		uid = string(value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store.GetUser(ctx, uid)
+}
+
+func (store *BoltStore) ListUsers(ctx context.Context) ([]*User, error) {
+	var users []*User
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(key, value []byte) error {
+			user := new(User)
+			if err := json.Unmarshal(value, user); err != nil {
+				return err
+			}
+
+			users = append(users, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (store *BoltStore) DeleteUser(ctx context.Context, uid string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+
+		value := users.Get([]byte(uid))
+		if value == nil {
+			return nil
+		}
+
+		user := new(User)
+		if err := json.Unmarshal(value, user); err != nil {
+			return err
+		}
+
+		if user.Token != "" {
+			if err := tx.Bucket(tokensBucket).Delete([]byte(user.Token)); err != nil {
+				return err
+			}
+		}
+
+		return users.Delete([]byte(uid))
+	})
+}
+
+func (store *BoltStore) SaveInvite(ctx context.Context, invite *Invite) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(invitesBucket).Put([]byte(invite.ID), toJSON(invite))
+	})
+}
+
+func (store *BoltStore) ListInvites(ctx context.Context) ([]*Invite, error) {
+	var invites []*Invite
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(invitesBucket).ForEach(func(id, value []byte) error {
+			invite := new(Invite)
+			if err := json.Unmarshal(value, invite); err != nil {
+				return err
+			}
+
+			invites = append(invites, invite)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return invites, nil
+}
+
+func (store *BoltStore) DeleteInvite(ctx context.Context, id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(invitesBucket).Delete([]byte(id))
+	})
+}
+
+// there are only ever a few invites, so they're looked through instead of indexing their hashes
+func (store *BoltStore) UseInvite(ctx context.Context, hash string) (*Invite, error) {
+	var found *Invite
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(invitesBucket)
+
+		err := bucket.ForEach(func(id, value []byte) error {
+			invite := new(Invite)
+			if err := json.Unmarshal(value, invite); err != nil {
+				return err
+			}
+
+			if invite.Hash == hash {
+				found = invite
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if found == nil {
+			return ErrRecordNotFound
+		}
+
+		return bucket.Delete([]byte(found.ID))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+func (store *BoltStore) SavePendingUpload(ctx context.Context, upload *PendingUpload) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).Put([]byte(upload.Key), toJSON(upload))
+	})
+}
+
+func (store *BoltStore) GetPendingUpload(ctx context.Context, key string) (*PendingUpload, error) {
+	upload := new(PendingUpload)
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(uploadsBucket).Get([]byte(key))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		return json.Unmarshal(value, upload)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (store *BoltStore) ListPendingUploads(ctx context.Context) ([]*PendingUpload, error) {
+	var uploads []*PendingUpload
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).ForEach(func(key, value []byte) error {
+			upload := new(PendingUpload)
+			if err := json.Unmarshal(value, upload); err != nil {
+				return err
+			}
+
+			uploads = append(uploads, upload)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return uploads, nil
+}
+
+func (store *BoltStore) DeletePendingUpload(ctx context.Context, key string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).Delete([]byte(key))
+	})
+}
+
+func (store *BoltStore) GetUsage(ctx context.Context, uid string) (*Usage, error) {
+	usage := new(Usage)
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(usageBucket).Get([]byte(uid))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		return json.Unmarshal(value, usage)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func (store *BoltStore) InitUsage(ctx context.Context, uid string, usage *Usage) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usageBucket)
+		if bucket.Get([]byte(uid)) != nil {
+			return nil
+		}
+
+		return bucket.Put([]byte(uid), toJSON(usage))
+	})
+}
+
+func (store *BoltStore) UpdateUsage(ctx context.Context, uid string, change func(usage *Usage) error) (*Usage, error) {
+	usage := new(Usage)
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usageBucket)
+		value := bucket.Get([]byte(uid))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		if err := json.Unmarshal(value, usage); err != nil {
+			return err
+		}
+
+		if err := change(usage); err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(uid), toJSON(usage))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func (store *BoltStore) SaveKey(ctx context.Context, key *APIKey) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		keys, hashes := tx.Bucket(keysBucket), tx.Bucket(keyHashesBucket)
+
+		if value := keys.Get([]byte(key.ID)); value != nil {
+			old := new(APIKey)
+			if err := json.Unmarshal(value, old); err != nil {
+				return err
+			}
+
+			if err := hashes.Delete([]byte(old.Hash)); err != nil {
+				return err
+			}
+		}
+
+		if err := hashes.Put([]byte(key.Hash), []byte(key.ID)); err != nil {
+			return err
+		}
+
+		return keys.Put([]byte(key.ID), toJSON(key))
+	})
+}
+
+func (store *BoltStore) GetKey(ctx context.Context, id string) (*APIKey, error) {
+	key := new(APIKey)
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(keysBucket).Get([]byte(id))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		return json.Unmarshal(value, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (store *BoltStore) GetKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	var id string
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(keyHashesBucket).Get([]byte(hash))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		id = string(value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store.GetKey(ctx, id)
+}
+
+func (store *BoltStore) ListKeys(ctx context.Context) ([]*APIKey, error) {
+	var keys []*APIKey
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(id, value []byte) error {
+			key := new(APIKey)
+			if err := json.Unmarshal(value, key); err != nil {
+				return err
+			}
+
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (store *BoltStore) DeleteKey(ctx context.Context, id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(keysBucket)
+
+		value := keys.Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+
+		key := new(APIKey)
+		if err := json.Unmarshal(value, key); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(keyHashesBucket).Delete([]byte(key.Hash)); err != nil {
+			return err
+		}
+
+		return keys.Delete([]byte(id))
+	})
+}
+
+func (store *BoltStore) MarkKeyUsed(ctx context.Context, id string, at time.Time) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(keysBucket)
+
+		value := keys.Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+
+		key := new(APIKey)
+		if err := json.Unmarshal(value, key); err != nil {
+			return err
+		}
+
+		key.LastUsed = &at
+		return keys.Put([]byte(id), toJSON(key))
+	})
+}
+
+func (store *BoltStore) SaveFile(ctx context.Context, file *File) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if err := removeFileIndexes(tx, file.ID); err != nil {
+			return err
+		}
+
+		if err := putFileIndexes(tx, file); err != nil {
+			return err
+		}
+
+		return tx.Bucket(filesBucket).Put([]byte(file.ID), toJSON(file))
+	})
+}
+
+func (store *BoltStore) GetFile(ctx context.Context, id string) (*File, error) {
+	file := new(File)
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(filesBucket).Get([]byte(id))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		return json.Unmarshal(value, file)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (store *BoltStore) ListFiles(ctx context.Context) ([]*File, error) {
+	var files []*File
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(key, value []byte) error {
+			file := new(File)
+			if err := json.Unmarshal(value, file); err != nil {
+				return err
+			}
+
+			files = append(files, file)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// seeks to the cursor in the files bucket or one of its indexes, filtering by owner as it goes
+func (store *BoltStore) ListFilesPage(ctx context.Context, query *FilesPageQuery) ([]*File, error) {
+	var files []*File
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(filesBucket)
+
+		bucket := records
+		switch query.Sort {
+		case "size":
+			bucket = tx.Bucket(sizesBucket)
+		case "last_modified":
+			bucket = tx.Bucket(uploadedBucket)
+		}
+
+		// only the files bucket is ordered by id, so only it can be limited to the prefix
+		var prefix []byte
+		if bucket == records {
+			prefix = []byte(query.Prefix)
+		}
+
+		var after []byte
+		if query.After != nil {
+			after = fileSortKey(query.Sort, query.After)
+		}
+
+		cursor := bucket.Cursor()
+		key := seekFiles(cursor, prefix, after, query.Descending)
+
+		for ; key != nil && bytes.HasPrefix(key, prefix) && len(files) < query.Limit; key = nextFile(cursor, query.Descending) {
+			value := records.Get(fileSortKeyID(query.Sort, key))
+			if value == nil {
+				continue
+			}
+
+			file := new(File)
+			if err := json.Unmarshal(value, file); err != nil {
+				return err
+			}
+
+			if query.Owner == "" || file.Owner == query.Owner {
+				files = append(files, file)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// moves the cursor to the first key after the last page, or to the start of the prefix for the first page
+func seekFiles(cursor *bolt.Cursor, prefix []byte, after []byte, descending bool) []byte {
+	if !descending {
+		if after == nil {
+			key, _ := cursor.Seek(prefix)
+			return key
+		}
+
+		key, _ := cursor.Seek(after)
+		if bytes.Equal(key, after) {
+			key, _ = cursor.Next()
+		}
+
+		return key
+	}
+
+	// going backwards starts from the last key before the end of the prefix or the last page
+	end := after
+	if end == nil && len(prefix) > 0 {
+		end = append(append([]byte(nil), prefix...), 0xff)
+	}
+
+	if end == nil {
+		key, _ := cursor.Last()
+		return key
+	}
+
+	if key, _ := cursor.Seek(end); key == nil {
+		key, _ = cursor.Last()
+		return key
+	}
+
+	key, _ := cursor.Prev()
+	return key
+}
+
+func nextFile(cursor *bolt.Cursor, descending bool) []byte {
+	if descending {
+		key, _ := cursor.Prev()
+		return key
+	}
+
+	key, _ := cursor.Next()
+	return key
+}
+
+// the key of a file in the bucket the files are sorted by, numbers are big endian so they sort like the bytes
+func fileSortKey(sort string, cursor *FileCursor) []byte {
+	var key []byte
+
+	switch sort {
+	case "size":
+		key = make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(cursor.Size))
+	case "last_modified":
+		key = timeKey(cursor.Uploaded)
+	}
+
+	return append(key, cursor.ID...)
+}
+
+// a time as 12 bytes that sort in order, the sign bit is flipped so times before 1970 still sort first
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint64(key, uint64(t.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(key[8:], uint32(t.Nanosecond()))
+	return key
+}
+
+func expiryKey(file *File) []byte {
+	return append(timeKey(*file.Expires), file.ID...)
+}
+
+func deletedKey(deleted time.Time, id string) []byte {
+	return append(timeKey(deleted), id...)
+}
+
+// the id of the file a sort key is for
+func fileSortKeyID(sort string, key []byte) []byte {
+	switch sort {
+	case "size":
+		return key[8:]
+	case "last_modified":
+		return key[12:]
+	}
+
+	return key
+}
+
+func (store *BoltStore) FindFilesByHash(ctx context.Context, sha256 string) ([]*File, error) {
+	var files []*File
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(sha256 + "/")
+		cursor := tx.Bucket(hashesBucket).Cursor()
+
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			value := tx.Bucket(filesBucket).Get(key[len(prefix):])
+			if value == nil {
+				continue
+			}
+
+			file := new(File)
+			if err := json.Unmarshal(value, file); err != nil {
+				return err
+			}
+
+			files = append(files, file)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (store *BoltStore) DeleteFile(ctx context.Context, id string) (*File, error) {
+	var file *File
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+		value := bucket.Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+
+		file = new(File)
+		if err := json.Unmarshal(value, file); err != nil {
+			return err
+		}
+
+		if err := removeFileIndexes(tx, id); err != nil {
+			return err
+		}
+
+		return bucket.Delete([]byte(id))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (store *BoltStore) CountDownload(ctx context.Context, id string) (*File, error) {
+	file := new(File)
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+		value := bucket.Get([]byte(id))
+		if value == nil {
+			return ErrRecordNotFound
+		}
+
+		if err := json.Unmarshal(value, file); err != nil {
+			return err
+		}
+
+		if file.MaxDownloads > 0 && file.Downloads >= file.MaxDownloads {
+			return ErrFileExpired
+		}
+
+		if err := removeFileIndexes(tx, id); err != nil {
+			return err
+		}
+
+		file.Downloads++
+		if file.MaxDownloads > 0 && file.Downloads >= file.MaxDownloads {
+			now := time.Now().UTC()
+			if file.Expires == nil || file.Expires.After(now) {
+				file.Expires = &now
+			}
+		}
+
+		if err := putFileIndexes(tx, file); err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(id), toJSON(file))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (store *BoltStore) ListExpiredFiles(ctx context.Context, before time.Time, limit int) ([]*File, error) {
+	var files []*File
+	end := timeKey(before)
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(filesBucket)
+		cursor := tx.Bucket(expiresBucket).Cursor()
+
+		for key, _ := cursor.First(); key != nil && bytes.Compare(key[:12], end) <= 0 && len(files) < limit; key, _ = cursor.Next() {
+			value := records.Get(key[12:])
+			if value == nil {
+				continue
+			}
+
+			file := new(File)
+			if err := json.Unmarshal(value, file); err != nil {
+				return err
+			}
+
+			files = append(files, file)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (store *BoltStore) ListTrashedFiles(ctx context.Context, before time.Time) ([]*File, error) {
+	var files []*File
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(filesBucket)
+
+		return listDeleted(tx.Bucket(deletedFilesBucket), before, func(id []byte) error {
+			value := records.Get(id)
+			if value == nil {
+				return nil
+			}
+
+			file := new(File)
+			if err := json.Unmarshal(value, file); err != nil {
+				return err
+			}
+
+			files = append(files, file)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// walks a trash index backwards from the time, calling fn with the id of everything deleted before it
+func listDeleted(bucket *bolt.Bucket, before time.Time, fn func(id []byte) error) error {
+	cursor := bucket.Cursor()
+
+	key, _ := cursor.Seek(timeKey(before))
+	if key == nil {
+		key, _ = cursor.Last()
+	} else {
+		key, _ = cursor.Prev()
+	}
+
+	for ; key != nil; key, _ = cursor.Prev() {
+		if err := fn(key[12:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *BoltStore) Close() error {
+	return store.db.Close()
+}
+
+func hashKey(file *File) []byte {
+	return []byte(file.SHA256 + "/" + file.ID)
+}
+
+// adds the file to the hash, size, upload time, expiry and trash indexes
+func putFileIndexes(tx *bolt.Tx, file *File) error {
+	if file.SHA256 != "" {
+		if err := tx.Bucket(hashesBucket).Put(hashKey(file), nil); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Bucket(sizesBucket).Put(fileSortKey("size", file.cursor()), nil); err != nil {
+		return err
+	}
+
+	if file.Expires != nil {
+		if err := tx.Bucket(expiresBucket).Put(expiryKey(file), nil); err != nil {
+			return err
+		}
+	}
+
+	if file.Deleted != nil {
+		if err := tx.Bucket(deletedFilesBucket).Put(deletedKey(*file.Deleted, file.ID), nil); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(uploadedBucket).Put(fileSortKey("last_modified", file.cursor()), nil)
+}
+
+// removes the current record of the file from the indexes
+func removeFileIndexes(tx *bolt.Tx, id string) error {
+	value := tx.Bucket(filesBucket).Get([]byte(id))
+	if value == nil {
+		return nil
+	}
+
+	old := new(File)
+	if err := json.Unmarshal(value, old); err != nil {
+		return err
+	}
+
+	if old.SHA256 != "" {
+		if err := tx.Bucket(hashesBucket).Delete(hashKey(old)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Bucket(sizesBucket).Delete(fileSortKey("size", old.cursor())); err != nil {
+		return err
+	}
+
+	if old.Expires != nil {
+		if err := tx.Bucket(expiresBucket).Delete(expiryKey(old)); err != nil {
+			return err
+		}
+	}
+
+	if old.Deleted != nil {
+		if err := tx.Bucket(deletedFilesBucket).Delete(deletedKey(*old.Deleted, old.ID)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(uploadedBucket).Delete(fileSortKey("last_modified", old.cursor()))
+}
+
+// adds the folder to the trash index when it's in the trash
+func putFolderIndex(tx *bolt.Tx, data *FolderData) error {
+	if data.Deleted == nil {
+		return nil
+	}
+
+	return tx.Bucket(deletedFoldersBucket).Put(deletedKey(*data.Deleted, data.ID), nil)
+}
+
+func removeFolderIndex(tx *bolt.Tx, data *FolderData) error {
+	if data.Deleted == nil {
+		return nil
+	}
+
+	return tx.Bucket(deletedFoldersBucket).Delete(deletedKey(*data.Deleted, data.ID))
+}
+
+func (record *boltFolder) toFolder() *Folder {
+	return &Folder{
+		Data:       record.Data,
+		CreateTime: record.CreateTime,
+		UpdateTime: record.UpdateTime,
+	}
+}
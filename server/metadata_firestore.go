@@ -0,0 +1,693 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keeps metadata in Firebase Firestore
+type FirestoreStore struct {
+	client *firestore.Client
+}
+
+func NewFirestoreStore(client *firestore.Client) *FirestoreStore {
+	return &FirestoreStore{client: client}
+}
+
+func (store *FirestoreStore) folders() *firestore.CollectionRef {
+	return store.client.Collection("folders")
+}
+
+func (store *FirestoreStore) files() *firestore.CollectionRef {
+	return store.client.Collection("files")
+}
+
+func (store *FirestoreStore) users() *firestore.CollectionRef {
+	return store.client.Collection("users")
+}
+
+func (store *FirestoreStore) keys() *firestore.CollectionRef {
+	return store.client.Collection("keys")
+}
+
+func (store *FirestoreStore) invites() *firestore.CollectionRef {
+	return store.client.Collection("invites")
+}
+
+func (store *FirestoreStore) uploads() *firestore.CollectionRef {
+	return store.client.Collection("uploads")
+}
+
+func (store *FirestoreStore) usage() *firestore.CollectionRef {
+	return store.client.Collection("usage")
+}
+
+func (store *FirestoreStore) CreateFolder(ctx context.Context, data *FolderData) (*Folder, error) {
+	doc, err := store.folders().Doc(data.ID).Create(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Folder{
+		Data:       data,
+		CreateTime: doc.UpdateTime,
+		UpdateTime: doc.UpdateTime,
+	}, nil
+}
+
+func (store *FirestoreStore) GetFolder(ctx context.Context, id string) (*Folder, error) {
+	doc, err := store.folders().Doc(id).Get(ctx)
+	if err != nil {
+		return nil, firestoreError(err)
+	}
+
+	return firestoreFolder(doc)
+}
+
+func (store *FirestoreStore) ListFolders(ctx context.Context) ([]*Folder, error) {
+	docs, err := store.folders().Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	folders := make([]*Folder, len(docs))
+	for i, doc := range docs {
+		folder, err := firestoreFolder(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		folders[i] = folder
+	}
+
+	return folders, nil
+}
+
+func (store *FirestoreStore) ListTrashedFolders(ctx context.Context, before time.Time) ([]*Folder, error) {
+	docs, err := store.folders().Where("Deleted", "<", before).OrderBy("Deleted", firestore.Desc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	folders := make([]*Folder, len(docs))
+	for i, doc := range docs {
+		folder, err := firestoreFolder(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		folders[i] = folder
+	}
+
+	return folders, nil
+}
+
+func (store *FirestoreStore) UpdateFolder(ctx context.Context, folder *Folder) error {
+	updates := make([]firestore.Update, len(folder.Updates))
+	for i, update := range folder.Updates {
+		updates[i] = firestore.Update{
+			Path:  update.Path,
+			Value: firestoreValue(update),
+		}
+	}
+
+	result, err := store.folders().Doc(folder.Data.ID).Update(ctx, updates)
+	if err != nil {
+		return firestoreError(err)
+	}
+
+	folder.UpdateTime = result.UpdateTime
+	return nil
+}
+
+// lists are changed item by item so concurrent changes aren't lost
+func firestoreValue(update Update) interface{} {
+	files, _ := update.Value.([]string)
+	items := make([]interface{}, len(files))
+	for i, file := range files {
+		items[i] = file
+	}
+
+	switch update.Op {
+	case updateAdd:
+		return firestore.ArrayUnion(items...)
+	case updateRemove:
+		return firestore.ArrayRemove(items...)
+	default:
+		return update.Value
+	}
+}
+
+func (store *FirestoreStore) DeleteFolder(ctx context.Context, id string) error {
+	_, err := store.folders().Doc(id).Delete(ctx)
+	return err
+}
+
+func (store *FirestoreStore) RemoveFileFromFolders(ctx context.Context, key string) ([]string, error) {
+	var ids []string
+
+	err := store.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ids = nil
+
+		docs, err := tx.Documents(store.folders().Where("Files", "array-contains", key)).GetAll()
+		if err != nil {
+			return err
+		}
+
+		for _, doc := range docs {
+			err := tx.Update(doc.Ref, []firestore.Update{{
+				Path:  "Files",
+				Value: firestore.ArrayRemove(key),
+			}})
+			if err != nil {
+				return err
+			}
+
+			ids = append(ids, doc.Ref.ID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (store *FirestoreStore) SaveUser(ctx context.Context, user *User) error {
+	_, err := store.users().Doc(user.UID).Set(ctx, user)
+	return err
+}
+
+func (store *FirestoreStore) GetUser(ctx context.Context, uid string) (*User, error) {
+	doc, err := store.users().Doc(uid).Get(ctx)
+	if err != nil {
+		return nil, firestoreError(err)
+	}
+
+	user := new(User)
+	if err := doc.DataTo(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (store *FirestoreStore) GetUserByToken(ctx context.Context, token string) (*User, error) {
+	docs, err := store.users().Where("Token", "==", token).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(docs) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	user := new(User)
+	if err := docs[0].DataTo(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (store *FirestoreStore) ListUsers(ctx context.Context) ([]*User, error) {
+	docs, err := store.users().Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, len(docs))
+	for i, doc := range docs {
+		users[i] = new(User)
+		if err := doc.DataTo(users[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return users, nil
+}
+
+func (store *FirestoreStore) DeleteUser(ctx context.Context, uid string) error {
+	_, err := store.users().Doc(uid).Delete(ctx)
+	return err
+}
+
+func (store *FirestoreStore) SaveInvite(ctx context.Context, invite *Invite) error {
+	_, err := store.invites().Doc(invite.ID).Set(ctx, invite)
+	return err
+}
+
+func (store *FirestoreStore) ListInvites(ctx context.Context) ([]*Invite, error) {
+	docs, err := store.invites().Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	invites := make([]*Invite, len(docs))
+	for i, doc := range docs {
+		invites[i] = new(Invite)
+		if err := doc.DataTo(invites[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return invites, nil
+}
+
+func (store *FirestoreStore) DeleteInvite(ctx context.Context, id string) error {
+	_, err := store.invites().Doc(id).Delete(ctx)
+	return err
+}
+
+func (store *FirestoreStore) UseInvite(ctx context.Context, hash string) (*Invite, error) {
+	invite := new(Invite)
+
+	err := store.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.Documents(store.invites().Where("Hash", "==", hash).Limit(1)).GetAll()
+		if err != nil {
+			return err
+		}
+
+		if len(docs) == 0 {
+			return ErrRecordNotFound
+		}
+
+		if err := docs[0].DataTo(invite); err != nil {
+			return err
+		}
+
+		return tx.Delete(docs[0].Ref)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return invite, nil
+}
+
+func (store *FirestoreStore) SavePendingUpload(ctx context.Context, upload *PendingUpload) error {
+	_, err := store.uploads().Doc(upload.Key).Set(ctx, upload)
+	return err
+}
+
+func (store *FirestoreStore) GetPendingUpload(ctx context.Context, key string) (*PendingUpload, error) {
+	doc, err := store.uploads().Doc(key).Get(ctx)
+	if err != nil {
+		return nil, firestoreError(err)
+	}
+
+	upload := new(PendingUpload)
+	if err := doc.DataTo(upload); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (store *FirestoreStore) ListPendingUploads(ctx context.Context) ([]*PendingUpload, error) {
+	docs, err := store.uploads().Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := make([]*PendingUpload, len(docs))
+	for i, doc := range docs {
+		uploads[i] = new(PendingUpload)
+		if err := doc.DataTo(uploads[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return uploads, nil
+}
+
+func (store *FirestoreStore) DeletePendingUpload(ctx context.Context, key string) error {
+	_, err := store.uploads().Doc(key).Delete(ctx)
+	return err
+}
+
+func (store *FirestoreStore) GetUsage(ctx context.Context, uid string) (*Usage, error) {
+	doc, err := store.usage().Doc(uid).Get(ctx)
+	if err != nil {
+		return nil, firestoreError(err)
+	}
+
+	usage := new(Usage)
+	if err := doc.DataTo(usage); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func (store *FirestoreStore) InitUsage(ctx context.Context, uid string, usage *Usage) error {
+	_, err := store.usage().Doc(uid).Create(ctx, usage)
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+
+	return err
+}
+
+func (store *FirestoreStore) UpdateUsage(ctx context.Context, uid string, change func(usage *Usage) error) (*Usage, error) {
+	usage := new(Usage)
+	ref := store.usage().Doc(uid)
+
+	err := store.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return firestoreError(err)
+		}
+
+		usage = new(Usage)
+		if err := doc.DataTo(usage); err != nil {
+			return err
+		}
+
+		if err := change(usage); err != nil {
+			return err
+		}
+
+		return tx.Set(ref, usage)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func (store *FirestoreStore) SaveKey(ctx context.Context, key *APIKey) error {
+	_, err := store.keys().Doc(key.ID).Set(ctx, key)
+	return err
+}
+
+func (store *FirestoreStore) GetKey(ctx context.Context, id string) (*APIKey, error) {
+	doc, err := store.keys().Doc(id).Get(ctx)
+	if err != nil {
+		return nil, firestoreError(err)
+	}
+
+	key := new(APIKey)
+	if err := doc.DataTo(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (store *FirestoreStore) GetKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	docs, err := store.keys().Where("Hash", "==", hash).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(docs) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	key := new(APIKey)
+	if err := docs[0].DataTo(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (store *FirestoreStore) ListKeys(ctx context.Context) ([]*APIKey, error) {
+	docs, err := store.keys().Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*APIKey, len(docs))
+	for i, doc := range docs {
+		keys[i] = new(APIKey)
+		if err := doc.DataTo(keys[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+func (store *FirestoreStore) DeleteKey(ctx context.Context, id string) error {
+	_, err := store.keys().Doc(id).Delete(ctx)
+	return err
+}
+
+func (store *FirestoreStore) MarkKeyUsed(ctx context.Context, id string, at time.Time) error {
+	_, err := store.keys().Doc(id).Update(ctx, []firestore.Update{{
+		Path:  "LastUsed",
+		Value: at,
+	}})
+	if err := firestoreError(err); err != ErrRecordNotFound {
+		return err
+	}
+
+	return nil
+}
+
+func (store *FirestoreStore) SaveFile(ctx context.Context, file *File) error {
+	_, err := store.files().Doc(file.ID).Set(ctx, file)
+	return err
+}
+
+func (store *FirestoreStore) GetFile(ctx context.Context, id string) (*File, error) {
+	doc, err := store.files().Doc(id).Get(ctx)
+	if err != nil {
+		return nil, firestoreError(err)
+	}
+
+	file := new(File)
+	if err := doc.DataTo(file); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (store *FirestoreStore) ListFiles(ctx context.Context) ([]*File, error) {
+	docs, err := store.files().Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*File, len(docs))
+	for i, doc := range docs {
+		files[i] = new(File)
+		if err := doc.DataTo(files[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// the prefix is only applied when sorting by name, as firestore can only range over the field it orders by first
+func (store *FirestoreStore) ListFilesPage(ctx context.Context, query *FilesPageQuery) ([]*File, error) {
+	q := store.files().Query
+	if query.Owner != "" {
+		q = q.Where("Owner", "==", query.Owner)
+	}
+
+	direction := firestore.Asc
+	if query.Descending {
+		direction = firestore.Desc
+	}
+
+	switch query.Sort {
+	case "size":
+		q = q.OrderBy("Size", direction).OrderBy("ID", direction)
+	case "last_modified":
+		q = q.OrderBy("Uploaded", direction).OrderBy("ID", direction)
+	default:
+		if query.Prefix != "" {
+			q = q.Where("ID", ">=", query.Prefix).Where("ID", "<", query.Prefix+"\uf8ff")
+		}
+
+		q = q.OrderBy("ID", direction)
+	}
+
+	if after := query.After; after != nil {
+		switch query.Sort {
+		case "size":
+			q = q.StartAfter(after.Size, after.ID)
+		case "last_modified":
+			q = q.StartAfter(after.Uploaded, after.ID)
+		default:
+			q = q.StartAfter(after.ID)
+		}
+	}
+
+	docs, err := q.Limit(query.Limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*File, len(docs))
+	for i, doc := range docs {
+		files[i] = new(File)
+		if err := doc.DataTo(files[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func (store *FirestoreStore) ListExpiredFiles(ctx context.Context, before time.Time, limit int) ([]*File, error) {
+	docs, err := store.files().Where("Expires", "<=", before).OrderBy("Expires", firestore.Asc).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*File, len(docs))
+	for i, doc := range docs {
+		files[i] = new(File)
+		if err := doc.DataTo(files[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func (store *FirestoreStore) ListTrashedFiles(ctx context.Context, before time.Time) ([]*File, error) {
+	docs, err := store.files().Where("Deleted", "<", before).OrderBy("Deleted", firestore.Desc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*File, len(docs))
+	for i, doc := range docs {
+		files[i] = new(File)
+		if err := doc.DataTo(files[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func (store *FirestoreStore) FindFilesByHash(ctx context.Context, sha256 string) ([]*File, error) {
+	docs, err := store.files().Where("SHA256", "==", sha256).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*File, len(docs))
+	for i, doc := range docs {
+		files[i] = new(File)
+		if err := doc.DataTo(files[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func (store *FirestoreStore) DeleteFile(ctx context.Context, id string) (*File, error) {
+	var file *File
+	ref := store.files().Doc(id)
+
+	err := store.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		file = nil
+
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		file = new(File)
+		if err := doc.DataTo(file); err != nil {
+			return err
+		}
+
+		return tx.Delete(ref)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (store *FirestoreStore) CountDownload(ctx context.Context, id string) (*File, error) {
+	file := new(File)
+	ref := store.files().Doc(id)
+
+	err := store.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return firestoreError(err)
+		}
+
+		if err := doc.DataTo(file); err != nil {
+			return err
+		}
+
+		if file.MaxDownloads > 0 && file.Downloads >= file.MaxDownloads {
+			return ErrFileExpired
+		}
+
+		file.Downloads++
+		updates := []firestore.Update{{
+			Path:  "Downloads",
+			Value: firestore.Increment(1),
+		}}
+
+		if file.MaxDownloads > 0 && file.Downloads >= file.MaxDownloads {
+			now := time.Now().UTC()
+			if file.Expires == nil || file.Expires.After(now) {
+				file.Expires = &now
+				updates = append(updates, firestore.Update{
+					Path:  "Expires",
+					Value: now,
+				})
+			}
+		}
+
+		return tx.Update(ref, updates)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (store *FirestoreStore) Close() error {
+	return store.client.Close()
+}
+
+func firestoreFolder(doc *firestore.DocumentSnapshot) (*Folder, error) {
+	folder := &Folder{
+		Data:       new(FolderData),
+		CreateTime: doc.CreateTime,
+		UpdateTime: doc.UpdateTime,
+	}
+
+	if err := doc.DataTo(folder.Data); err != nil {
+		return nil, err
+	}
+
+	return folder, nil
+}
+
+// maps not found errors onto ErrRecordNotFound
+func firestoreError(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return ErrRecordNotFound
+	}
+
+	return err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"golang.org/x/crypto/argon2"
+)
+
+// passwords are hashed with argon2id and stored as argon2id$v=19$m=memory,t=time,p=threads$salt$hash
+const (
+	passwordMemory  = 19 * 1024
+	passwordTime    = 2
+	passwordThreads = 1
+	passwordKeySize = 32
+)
+
+const passwordSaltSize = 16
+const maxPasswordLength = 1024
+
+// how many passwords one address can try a minute
+const unlockAttempts = 10
+
+// how long a correct password unlocks a file for
+const unlockExpiry = time.Hour
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, passwordTime, passwordMemory, passwordThreads, passwordKeySize)
+
+	return fmt.Sprintf(
+		"argon2id$v=%v$m=%v,t=%v,p=%v$%v$%v",
+		argon2.Version,
+		passwordMemory,
+		passwordTime,
+		passwordThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+func checkPassword(encoded string, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[0] != "argon2id" {
+		return false
+	}
+
+	return checkArgon2id(parts, password)
+}
+
+func checkArgon2id(parts []string, password string) bool {
+	var version int
+	if _, err := fmt.Sscanf(parts[1], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil || iterations == 0 || threads == 0 {
+		return false
+	}
+
+	salt, hash, ok := decodeSaltAndHash(parts[3], parts[4])
+	if !ok {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(hash, key) == 1
+}
+
+func decodeSaltAndHash(encodedSalt string, encodedHash string) ([]byte, []byte, bool) {
+	salt, err := base64.RawStdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(encodedHash)
+	if err != nil || len(hash) == 0 {
+		return nil, nil, false
+	}
+
+	return salt, hash, true
+}
+
+// a file is unlocked by a cookie holding when it expires and a signature over the file and its password,
+// so changing the password locks it again
+func unlockCookieName(key string) string {
+	return "cdn_unlock_" + strings.ReplaceAll(key, ".", "_")
+}
+
+func unlockSignature(file *File, expires string) string {
+	return sign("unlock", file.ID, file.PasswordHash, expires)
+}
+
+func fileUnlocked(ctx *fiber.Ctx, file *File) bool {
+	parts := strings.SplitN(ctx.Cookies(unlockCookieName(file.ID)), ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return validSignature(parts[1], "unlock", file.ID, file.PasswordHash, parts[0])
+}
+
+func setUnlockCookie(ctx *fiber.Ctx, file *File) {
+	expires := time.Now().Add(unlockExpiry)
+	value := strconv.FormatInt(expires.Unix(), 10)
+
+	ctx.Cookie(&fiber.Cookie{
+		Name:     unlockCookieName(file.ID),
+		Value:    value + "." + unlockSignature(file, value),
+		Path:     "/" + file.ID,
+		Expires:  expires,
+		Secure:   cdnConfig.Production,
+		HTTPOnly: true,
+		SameSite: "Lax",
+	})
+}
+
+var passwordPrompt = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1">
+		<meta name="theme-color" content="#dd9323">
+		<title>{{.Key}}</title>
+	</head>
+	<body style="font-family: sans-serif; display: flex; justify-content: center; margin-top: 20vh;">
+		<form method="POST">
+			<p><b>{{.Key}}</b> is password protected.</p>
+			{{if .Wrong}}<p style="color: #c0392b;">Wrong password.</p>{{end}}
+			<input type="password" name="password" autofocus required>
+			<button type="submit">Unlock</button>
+		</form>
+	</body>
+</html>`))
+
+func sendPasswordPrompt(ctx *fiber.Ctx, key string, wrong bool) error {
+	ctx.Type("html", "utf-8")
+	ctx.Set("Cache-Control", "no-store")
+
+	if wrong {
+		ctx.Status(fiber.StatusUnauthorized)
+	}
+
+	return passwordPrompt.Execute(ctx, map[string]interface{}{
+		"Key":   key,
+		"Wrong": wrong,
+	})
+}
+
+// limits how many passwords each address can try, as the prompt needs no authorization
+func unlockLimiter() fiber.Handler {
+	return limiter.New(limiter.Config{
+		Max:        unlockAttempts,
+		Expiration: time.Minute,
+		LimitReached: func(ctx *fiber.Ctx) error {
+			return fiber.NewError(fiber.StatusTooManyRequests, "Too many password attempts, try again later.")
+		},
+	})
+}
+
+// checks the password sent from the prompt and goes back to the file with it unlocked
+func unlockFileRoute(ctx *fiber.Ctx) error {
+	key := ctx.Params("file")
+
+	file, err := fileAvailable(ctx.Context(), key)
+	if err != nil {
+		return storageError(err)
+	}
+
+	if file == nil || file.PasswordHash == "" {
+		return fiber.NewError(fiber.StatusNotFound, "File not found.")
+	}
+
+	if !checkPassword(file.PasswordHash, ctx.FormValue("password")) {
+		return sendPasswordPrompt(ctx, key, true)
+	}
+
+	setUnlockCookie(ctx, file)
+
+	return ctx.Redirect(ctx.OriginalURL(), fiber.StatusSeeOther)
+}
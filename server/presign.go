@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// uploads that go straight to the bucket through a presigned url,
+// the server only hands out the url and checks the object once the client says it's done.
+// objects are uploaded private and only made public when they're completed
+
+// how long a presigned url can be used for
+const presignExpiry = 15 * time.Minute
+
+// how long an upload can still be completed for, anything left after is deleted
+const pendingUploadExpiry = 24 * time.Hour
+
+// the largest object a single presigned PUT can create
+const maxPresignSize = 5 * 1024 * 1024 * 1024
+
+// gets a pending upload of the owner that can still be completed
+func pendingUploadFor(ctx context.Context, key string, owner string) (*PendingUpload, error) {
+	upload, err := cdnMetadata.GetPendingUpload(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// streamed uploads are completed by the request storing them
+	if upload.Options.Owner != owner || upload.Size < 0 || time.Since(upload.Created) > pendingUploadExpiry {
+		return nil, ErrRecordNotFound
+	}
+
+	return upload, nil
+}
+
+// whether the key belongs to an upload that isn't completed, expired ones included as their
+// object is still there until they're cleaned up
+func isPendingUpload(ctx context.Context, key string) (bool, error) {
+	_, err := cdnMetadata.GetPendingUpload(ctx, key)
+	if err == ErrRecordNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// deletes the object and the record of an upload that won't be completed and gives back its usage
+func discardPendingUpload(ctx context.Context, upload *PendingUpload) {
+	if err := cdnStorage.Delete(ctx, upload.Key); err != nil && err != ErrObjectNotFound {
+		log.Printf("Failed to delete object of upload %v: %v", upload.Key, err)
+		return
+	}
+
+	if err := cdnMetadata.DeletePendingUpload(ctx, upload.Key); err != nil {
+		log.Printf("Failed to delete upload %v: %v", upload.Key, err)
+		return
+	}
+
+	if upload.Size >= 0 {
+		releaseQuota(ctx, upload.Options.Owner, upload.Size, upload.Created)
+	}
+}
+
+func cleanUpPendingUploads() {
+	uploads, err := cdnMetadata.ListPendingUploads(context.Background())
+	if err != nil {
+		log.Printf("Failed to list pending uploads: %v", err)
+		return
+	}
+
+	for _, upload := range uploads {
+		if time.Since(upload.Created) > pendingUploadExpiry {
+			log.Printf("Removing expired upload %v", upload.Key)
+			discardPendingUpload(context.Background(), upload)
+		}
+	}
+}
+
+func startPresignCleanUp() {
+	go func() {
+		for {
+			cleanUpPendingUploads()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func presignUploadRoute(ctx *fiber.Ctx) error {
+	presigner, ok := unwrapStorage(cdnStorage).(PresignedStorage)
+	if !ok {
+		respErr := NewResponse(fiber.StatusNotImplemented, "Storage does not support direct uploads.")
+		return ctx.JSON(respErr)
+	}
+
+	body := new(PresignRequest)
+
+	if err := ctx.BodyParser(body); err != nil {
+		respErr := NewResponseByError(fiber.StatusBadRequest, err)
+		return ctx.JSON(respErr)
+	}
+
+	if body.Size <= 0 || body.Size > maxPresignSize {
+		respErr := NewResponse(fiber.StatusBadRequest, fmt.Sprintf("Size must be between 1 and %v bytes.", maxPresignSize))
+		return ctx.JSON(respErr)
+	}
+
+	if body.ContentType == "" {
+		body.ContentType = "application/octet-stream"
+	}
+
+	opts, respErr := parseUploadOptions(func(key string) string {
+		switch key {
+		case "expires_in":
+			if body.ExpiresIn != 0 {
+				return strconv.FormatInt(body.ExpiresIn, 10)
+			}
+		case "expires_at":
+			return body.ExpiresAt
+		case "max_downloads":
+			if body.MaxDownloads != 0 {
+				return strconv.Itoa(body.MaxDownloads)
+			}
+		case "burn_after_read":
+			return strconv.FormatBool(body.BurnAfterRead)
+		case "password":
+			return body.Password
+		case "visibility":
+			return body.Visibility
+		}
+
+		return ""
+	})
+	if respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	opts.Owner = currentUser(ctx).UID
+
+	// the usage is reserved until the upload is completed or discarded
+	if respErr := reserveQuota(ctx.Context(), opts.Owner, body.Size); respErr != nil {
+		return sendUploadError(ctx, respErr)
+	}
+
+	now := time.Now().UTC()
+	upload := &PendingUpload{
+		Key:         randSeq(8) + filepath.Ext(body.FileName),
+		FileName:    body.FileName,
+		Size:        body.Size,
+		ContentType: body.ContentType,
+		Options:     opts,
+		Created:     now,
+		Expires:     now.Add(presignExpiry),
+	}
+
+	// saved before the url is handed out so the object is never in the bucket without it
+	if err := cdnMetadata.SavePendingUpload(ctx.Context(), upload); err != nil {
+		releaseQuota(ctx.Context(), opts.Owner, body.Size, now)
+
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	url, headers, err := presigner.PresignPut(upload.Key, &PutOptions{
+		Size:        body.Size,
+		ContentType: body.ContentType,
+		Private:     true,
+	}, presignExpiry)
+	if err != nil {
+		discardPendingUpload(ctx.Context(), upload)
+
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	result := &PresignResult{
+		Key:       upload.Key,
+		Url:       url,
+		Method:    fiber.MethodPut,
+		Headers:   make(map[string]string),
+		ExpiresAt: upload.Expires,
+	}
+
+	for name, values := range headers {
+		// the host header is set by the client itself
+		if !strings.EqualFold(name, "Host") {
+			result.Headers[name] = strings.Join(values, ",")
+		}
+	}
+
+	return ctx.JSON(result)
+}
+
+func completeUploadRoute(ctx *fiber.Ctx) error {
+	body := new(PresignCompleteRequest)
+
+	if err := ctx.BodyParser(body); err != nil {
+		respErr := NewResponseByError(fiber.StatusBadRequest, err)
+		return ctx.JSON(respErr)
+	}
+
+	upload, err := pendingUploadFor(ctx.Context(), body.Key, currentUser(ctx).UID)
+	if err == ErrRecordNotFound {
+		respErr := NewResponse(fiber.StatusNotFound, "No pending upload for this key.")
+		return ctx.JSON(respErr)
+	} else if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	info, err := cdnStorage.Head(ctx.Context(), body.Key)
+	if err == ErrObjectNotFound {
+		respErr := NewResponse(fiber.StatusNotFound, "File was not uploaded.")
+		return ctx.JSON(respErr)
+	} else if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	if info.Size != upload.Size || info.ContentType != upload.ContentType {
+		// the signature should prevent this, but never keep an object that doesn't match what was asked for
+		discardPendingUpload(ctx.Context(), upload)
+
+		respErr := NewResponse(fiber.StatusBadRequest, "Uploaded file does not match the requested size and type.")
+		return ctx.JSON(respErr)
+	}
+
+	if !upload.Options.private() {
+		if err := cdnStorage.SetPrivate(ctx.Context(), body.Key, false); err != nil {
+			respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+			return ctx.JSON(respErr)
+		}
+	}
+
+	// the server never sees the contents, so only the md5 from the etag is known
+	err = cdnMetadata.SaveFile(ctx.Context(), &File{
+		ID:           body.Key,
+		Ext:          filepath.Ext(body.Key),
+		Name:         upload.FileName,
+		ContentType:  info.ContentType,
+		Owner:        upload.Options.Owner,
+		Size:         info.Size,
+		MD5:          etagMD5(info.ETag),
+		Uploaded:     info.LastModified.UTC(),
+		Expires:      upload.Options.Expires,
+		MaxDownloads: upload.Options.MaxDownloads,
+		PasswordHash: upload.Options.PasswordHash,
+		Private:      upload.Options.Private,
+	})
+	if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	if err := cdnMetadata.DeletePendingUpload(ctx.Context(), body.Key); err != nil {
+		log.Printf("Failed to delete completed upload %v: %v", body.Key, err)
+	}
+
+	return ctx.JSON(ImageResult{
+		Code:    200,
+		Url:     fmt.Sprintf("%v/%v", cdnConfig.CdnEndpoint, body.Key),
+		Success: true,
+	})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// users get the default quota from the config unless an admin gave them their own, admins have no quota.
+// usage is kept in the metadata store and reserved in one transaction before a file is stored, so
+// concurrent uploads can't both pass the check. files in the trash count until they're purged
+
+// the quota that applies to the user, nil when there's no limit at all
+func quotaFor(user *User) *Quota {
+	if user.Admin {
+		return nil
+	}
+
+	if user.Quota != nil {
+		return user.Quota
+	}
+
+	return &cdnConfig.DefaultQuota
+}
+
+// errQuotaExceeded aborts the transaction of a reservation that's over the quota
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// the utc day uploads are counted for
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// starts counting uploads again on a new day
+func (usage *Usage) rollOver() {
+	if day := today(); usage.Day != day {
+		usage.Day = day
+		usage.Uploads = 0
+	}
+}
+
+// gets the usage counters of the user, counting them from the index the first time
+func usageFor(ctx context.Context, uid string) (*Usage, error) {
+	usage, err := cdnMetadata.GetUsage(ctx, uid)
+	if err == ErrRecordNotFound {
+		counted, err := countUsage(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+
+		// another request may have counted them in the meantime, the first one is kept
+		if err := cdnMetadata.InitUsage(ctx, uid, counted); err != nil {
+			return nil, err
+		}
+
+		usage, err = cdnMetadata.GetUsage(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	usage.rollOver()
+	return usage, nil
+}
+
+// counts the files of the user in the index, only used for users whose usage was never kept
+func countUsage(ctx context.Context, uid string) (*Usage, error) {
+	usage := &Usage{Day: today()}
+	query := &FilesPageQuery{
+		Owner: uid,
+		Sort:  "name",
+		Limit: maxFilesLimit,
+	}
+
+	for {
+		files, err := cdnMetadata.ListFilesPage(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			usage.Bytes += file.Size
+			usage.Files++
+
+			if file.Uploaded.UTC().Format("2006-01-02") == usage.Day {
+				usage.Uploads++
+			}
+		}
+
+		if len(files) < query.Limit {
+			return usage, nil
+		}
+
+		query.After = &FileCursor{ID: files[len(files)-1].ID}
+	}
+}
+
+// gets the stored user, including the admin behind AUTHORIZATION. api keys without the admin scope
+// act as a copy of their owner without admin rights, but the quota is always the one of the owner
+func storedUser(ctx context.Context, uid string) (*User, error) {
+	if uid == adminUID {
+		return adminUser, nil
+	}
+
+	return cdnMetadata.GetUser(ctx, uid)
+}
+
+// checks the usage leaves room for another file of the size
+func (quota *Quota) check(usage *Usage, size int64) *JSONResponse {
+	if quota.FileSize > 0 && size > quota.FileSize {
+		return quotaExceeded(fiber.StatusRequestEntityTooLarge, fmt.Sprintf("File is larger than the %v bytes allowed.", quota.FileSize), &QuotaExceeded{
+			Limit: "file_size",
+			Quota: quota.FileSize,
+			Usage: size,
+		})
+	}
+
+	if quota.Bytes > 0 && usage.Bytes+size > quota.Bytes {
+		return quotaExceeded(fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Upload would exceed the storage quota of %v bytes.", quota.Bytes), &QuotaExceeded{
+			Limit: "bytes",
+			Quota: quota.Bytes,
+			Usage: usage.Bytes,
+		})
+	}
+
+	if quota.Files > 0 && usage.Files >= quota.Files {
+		return quotaExceeded(fiber.StatusRequestEntityTooLarge, fmt.Sprintf("File quota of %v files reached.", quota.Files), &QuotaExceeded{
+			Limit: "files",
+			Quota: quota.Files,
+			Usage: usage.Files,
+		})
+	}
+
+	if quota.UploadsPerDay > 0 && usage.Uploads >= quota.UploadsPerDay {
+		// uploads are counted again from midnight utc
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+		return quotaExceeded(fiber.StatusTooManyRequests, fmt.Sprintf("Upload limit of %v a day reached.", quota.UploadsPerDay), &QuotaExceeded{
+			Limit:      "uploads_per_day",
+			Quota:      quota.UploadsPerDay,
+			Usage:      usage.Uploads,
+			RetryAfter: int64(midnight.Sub(now).Seconds()) + 1,
+		})
+	}
+
+	return nil
+}
+
+// checks the owner could upload another file of the size without reserving anything, for uploads
+// that are only stored later and reserve their usage then
+func checkQuota(ctx context.Context, owner string, size int64) *JSONResponse {
+	user, err := storedUser(ctx, owner)
+	if err != nil {
+		return NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	quota := quotaFor(user)
+	if quota == nil {
+		return nil
+	}
+
+	usage, err := usageFor(ctx, owner)
+	if err != nil {
+		return NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	return quota.check(usage, size)
+}
+
+// checks the owner can upload another file of the size and counts it in one transaction. the usage
+// has to be given back with releaseQuota when the file isn't stored after all
+func reserveQuota(ctx context.Context, owner string, size int64) *JSONResponse {
+	user, err := storedUser(ctx, owner)
+	if err != nil {
+		return NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	// makes sure the counters exist before they're changed
+	if _, err := usageFor(ctx, owner); err != nil {
+		return NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	quota := quotaFor(user)
+
+	var respErr *JSONResponse
+	_, err = cdnMetadata.UpdateUsage(ctx, owner, func(usage *Usage) error {
+		// the transaction can be run again, only the last run counts
+		respErr = nil
+		usage.rollOver()
+
+		if quota != nil {
+			if respErr = quota.check(usage, size); respErr != nil {
+				return errQuotaExceeded
+			}
+		}
+
+		usage.Bytes += size
+		usage.Files++
+		usage.Uploads++
+		return nil
+	})
+	if err == errQuotaExceeded {
+		return respErr
+	} else if err != nil {
+		return NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	return nil
+}
+
+// gives back the usage reserved at the time for a file that wasn't stored
+func releaseQuota(ctx context.Context, owner string, size int64, reserved time.Time) {
+	day := reserved.UTC().Format("2006-01-02")
+
+	changeUsage(ctx, owner, func(usage *Usage) {
+		usage.Bytes -= size
+		usage.Files--
+
+		if usage.Day == day {
+			usage.Uploads--
+		}
+	})
+}
+
+// gives back the storage of a file that was purged, its upload still counts for the day
+func releaseFile(ctx context.Context, file *File) {
+	changeUsage(ctx, file.Owner, func(usage *Usage) {
+		usage.Bytes -= file.Size
+		usage.Files--
+	})
+}
+
+// changes the counters of the user, they're counted from the index later when they were never kept
+func changeUsage(ctx context.Context, owner string, change func(usage *Usage)) {
+	if owner == "" {
+		return
+	}
+
+	_, err := cdnMetadata.UpdateUsage(ctx, owner, func(usage *Usage) error {
+		change(usage)
+
+		if usage.Bytes < 0 {
+			usage.Bytes = 0
+		}
+		if usage.Files < 0 {
+			usage.Files = 0
+		}
+		if usage.Uploads < 0 {
+			usage.Uploads = 0
+		}
+
+		return nil
+	})
+	if err != nil && err != ErrRecordNotFound {
+		log.Printf("Failed to update the usage of %v: %v", owner, err)
+	}
+}
+
+func quotaExceeded(code int, message string, exceeded *QuotaExceeded) *JSONResponse {
+	respErr := NewResponse(code, message)
+	respErr.Data = exceeded
+	return respErr
+}
+
+// responds with an upload error, quota errors also get their status code so clients can tell them apart
+func sendUploadError(ctx *fiber.Ctx, respErr *JSONResponse) error {
+	if exceeded, ok := respErr.Data.(*QuotaExceeded); ok {
+		ctx.Status(respErr.Code)
+
+		if exceeded.RetryAfter > 0 {
+			ctx.Set("Retry-After", strconv.FormatInt(exceeded.RetryAfter, 10))
+		}
+	}
+
+	return ctx.JSON(respErr)
+}
+
+// the usage of the user against their quota, admins can ask for any user with the user query parameter
+func getUsageRoute(ctx *fiber.Ctx) error {
+	id := currentUser(ctx).UID
+
+	if other := ctx.Query("user"); other != "" && other != id {
+		if !currentUser(ctx).Admin {
+			respErr := NewResponse(fiber.StatusForbidden, "Only admins can see the usage of others.")
+			return ctx.JSON(respErr)
+		}
+
+		id = other
+	}
+
+	user, err := storedUser(ctx.Context(), id)
+	if err == ErrRecordNotFound {
+		respErr := NewResponse(fiber.StatusNotFound, "User not found.")
+		return ctx.JSON(respErr)
+	} else if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	usage, err := usageFor(ctx.Context(), user.UID)
+	if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(&UsageResult{
+		User:    user.UID,
+		Usage:   usage,
+		Quota:   quotaFor(user),
+		Success: true,
+		Code:    200,
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// objects, records and references newer than this are left alone, they may belong to an upload that's still being saved
+const reconcileGracePeriod = time.Hour
+
+type ReconcileOptions struct {
+	// only report what would be fixed
+	DryRun bool
+	// delete objects nothing knows about instead of importing them into the index
+	DeleteOrphans bool
+	// download imported objects to compute their hashes
+	Hash bool
+}
+
+// checks the index and folders against storage and reports or fixes whatever doesn't match:
+// folders referencing files that are gone, index records without an object, objects nothing
+// knows about and records whose size differs from the object
+func Reconcile(ctx context.Context, opts *ReconcileOptions) (*ReconcileReport, error) {
+	report := &ReconcileReport{
+		Started: time.Now().UTC(),
+		DryRun:  opts.DryRun,
+	}
+
+	objects, err := listObjects(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// read after the objects, an upload saves its pending record before the object is put
+	uploads, err := cdnMetadata.ListPendingUploads(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := cdnMetadata.ListFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := cdnMetadata.ListFolders(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Objects, report.Files, report.Folders = len(objects), len(files), len(folders)
+
+	// objects are listed before the index is read, so anything newer than this may not be in the listing
+	cutoff := report.Started.Add(-reconcileGracePeriod)
+
+	stored := make(map[string]*ObjectInfo, len(objects))
+	for _, obj := range objects {
+		stored[obj.Key] = obj
+	}
+
+	indexed := make(map[string]*File, len(files))
+	for _, file := range files {
+		indexed[file.ID] = file
+	}
+
+	// objects of uploads that can still be completed are theirs, the presign clean up deletes them otherwise
+	pending := make(map[string]bool, len(uploads))
+	for _, upload := range uploads {
+		pending[upload.Key] = true
+	}
+
+	referenced := make(map[string]bool)
+
+	for _, folder := range folders {
+		var dangling []string
+		for _, key := range folder.Data.Files {
+			referenced[key] = true
+
+			if file := indexed[key]; file != nil && file.Uploaded.After(cutoff) {
+				continue
+			}
+
+			if stored[key] == nil && objectGone(ctx, key) {
+				dangling = append(dangling, key)
+				report.DanglingReferences = append(report.DanglingReferences, &DanglingReference{
+					Folder: folder.Data.ID,
+					Key:    key,
+				})
+			}
+		}
+
+		// only the removals are saved, the folder is read again when they're applied
+		if len(dangling) > 0 && !opts.DryRun {
+			folder.RemoveFiles(dangling)
+			if respErr := folder.Save(ctx); respErr != nil {
+				report.addError("removing files from folder %v: %v", folder.Data.ID, respErr.Message)
+			}
+		}
+	}
+
+	for _, file := range files {
+		if file.Uploaded.After(cutoff) {
+			continue
+		}
+
+		obj := stored[file.ID]
+		if obj == nil {
+			if !objectGone(ctx, file.ID) {
+				continue
+			}
+
+			report.MissingObjects = append(report.MissingObjects, file.ID)
+			if !opts.DryRun {
+				if record, err := cdnMetadata.DeleteFile(ctx, file.ID); err != nil {
+					report.addError("deleting record %v: %v", file.ID, err)
+				} else if record != nil {
+					releaseFile(ctx, record)
+				}
+			}
+			continue
+		}
+
+		if obj.Size != file.Size {
+			report.SizeMismatches = append(report.SizeMismatches, &SizeMismatch{
+				Key:         file.ID,
+				IndexSize:   file.Size,
+				StorageSize: obj.Size,
+			})
+
+			if !opts.DryRun {
+				delta := obj.Size - file.Size
+				file.Size = obj.Size
+				if err := cdnMetadata.SaveFile(ctx, file); err != nil {
+					report.addError("updating record %v: %v", file.ID, err)
+				} else if file.Owner != "" {
+					changeUsage(ctx, file.Owner, func(usage *Usage) {
+						usage.Bytes += delta
+					})
+				}
+			}
+		}
+	}
+
+	for _, obj := range objects {
+		if indexed[obj.Key] != nil || pending[obj.Key] || obj.LastModified.After(cutoff) || recorded(ctx, obj.Key) {
+			continue
+		}
+
+		// files a folder still points at are kept whatever the options say
+		deleteObject := opts.DeleteOrphans && !referenced[obj.Key]
+		if referenced[obj.Key] {
+			report.UnindexedObjects = append(report.UnindexedObjects, obj.Key)
+		} else {
+			report.OrphanedObjects = append(report.OrphanedObjects, obj.Key)
+		}
+
+		if opts.DryRun {
+			continue
+		}
+
+		if deleteObject {
+			if err := cdnStorage.Delete(ctx, obj.Key); err != nil {
+				report.addError("deleting object %v: %v", obj.Key, err)
+			}
+			continue
+		}
+
+		file, err := importObject(ctx, obj.Key, opts.Hash)
+		if err == nil {
+			err = cdnMetadata.SaveFile(ctx, file)
+		}
+
+		if err != nil {
+			report.addError("importing object %v: %v", obj.Key, err)
+		}
+	}
+
+	report.Finished = time.Now().UTC()
+	return report, nil
+}
+
+// checks storage again for an object missing from the listing, it may have been stored since
+func objectGone(ctx context.Context, key string) bool {
+	_, err := cdnStorage.Head(ctx, key)
+	return err == ErrObjectNotFound
+}
+
+// checks the index again for an object without a record, it may have been recorded since
+func recorded(ctx context.Context, key string) bool {
+	_, err := cdnMetadata.GetFile(ctx, key)
+	return err != ErrRecordNotFound
+}
+
+// builds the record of an object already in storage, the original file name isn't known so the key is used
+func importObject(ctx context.Context, key string, hash bool) (*File, error) {
+	info, err := cdnStorage.Head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		ID:          key,
+		Ext:         filepath.Ext(key),
+		Name:        key,
+		ContentType: info.ContentType,
+		Size:        info.Size,
+		MD5:         etagMD5(info.ETag),
+		Uploaded:    info.LastModified.UTC(),
+	}
+
+	if !hash {
+		return file, nil
+	}
+
+	body, _, err := cdnStorage.Get(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+
+	file.SHA256, file.MD5, err = hashReader(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (report *ReconcileReport) addError(format string, args ...interface{}) {
+	report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+}
+
+// runs the reconcile job once and writes the report as json
+func reconcileCommand(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be fixed")
+	deleteOrphans := flags.Bool("delete-orphans", false, "delete objects nothing knows about instead of importing them")
+	hash := flags.Bool("hash", false, "download every imported file to compute its hashes")
+	output := flags.String("report", "", "write the report to this file instead of stdout")
+	flags.Parse(args)
+
+	report, err := Reconcile(context.Background(), &ReconcileOptions{
+		DryRun:        *dryRun,
+		DeleteOrphans: *deleteOrphans,
+		Hash:          *hash,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatal(err)
+		}
+
+		defer out.Close()
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runs the reconcile job on the configured interval, logging a summary of every run
+func startReconcile() {
+	if cdnConfig.ReconcileInterval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(cdnConfig.ReconcileInterval)
+
+			report, err := Reconcile(context.Background(), &ReconcileOptions{
+				DryRun:        cdnConfig.ReconcileDryRun,
+				DeleteOrphans: cdnConfig.ReconcileDeleteOrphans,
+			})
+			if err != nil {
+				log.Printf("Reconcile failed: %v", err)
+				continue
+			}
+
+			log.Printf(
+				"Reconciled %v objects: %v dangling references, %v missing objects, %v orphaned objects, %v unindexed objects, %v size mismatches, %v errors",
+				report.Objects, len(report.DanglingReferences), len(report.MissingObjects), len(report.OrphanedObjects),
+				len(report.UnindexedObjects), len(report.SizeMismatches), len(report.Errors),
+			)
+		}
+	}()
+}
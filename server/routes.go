@@ -1,14 +1,10 @@
 package main
 
 import (
-	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"strconv"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -28,7 +24,7 @@ func verifyAuthRoute(ctx *fiber.Ctx) error {
 		})
 	}
 
-	if body.Token != cdnConfig.Authorization {
+	if _, _, err := authenticate(ctx.Context(), body.Token); err != nil {
 		return ctx.JSON(&TokenRequest{
 			Success: false,
 			Message: "Invalid authorization token provided.",
@@ -42,33 +38,42 @@ func verifyAuthRoute(ctx *fiber.Ctx) error {
 
 func getOGEmbedRoute(ctx *fiber.Ctx) error {
 	file := ctx.Params("file")
-	imageURL := fmt.Sprintf("%v/%v", cdnConfig.SpacesConfig.SpacesUrl, file)
 
-	res, headErr := http.Head(imageURL)
-	if headErr != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, headErr.Error())
+	record, err := fileAvailable(ctx.Context(), file)
+	if err != nil {
+		return storageError(err)
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return fiber.NewError(res.StatusCode, "An error occurred redirecting to the image.")
+	// nothing about private, protected or limited files is given away to embeds
+	if record != nil && record.proxied() {
+		if isPreviewBot(ctx) {
+			return fiber.NewError(fiber.StatusNotFound, "File not found.")
+		}
+
+		// keeps the signature of private links
+		url := fmt.Sprintf("%v/%v", cdnConfig.CdnEndpoint, file)
+		if query := string(ctx.Request().URI().QueryString()); query != "" {
+			url += "?" + query
+		}
+
+		return ctx.Redirect(url, fiber.StatusFound)
 	}
 
-	if ctx.Get("User-Agent") == "Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)" {
+	info, err := cdnStorage.Head(ctx.Context(), file)
+	if err != nil {
+		return storageError(err)
+	}
+
+	if isPreviewBot(ctx) {
 		ctx.Type("json", "utf-8")
-		contentLengthHeader := res.Header.Values("content-length")[0]
-		contentTypeHeader := res.Header.Values("content-type")[0]
-		contentLength, parseErr := strconv.ParseInt(contentLengthHeader, 0, 64)
-		if parseErr != nil {
-			return fiber.NewError(fiber.StatusInternalServerError, parseErr.Error())
-		}
 
 		var objType string
-		objAuthor := fmt.Sprintf("%v | %v", getFileSize(contentLength), contentTypeHeader)
-		objProvider := res.Header.Values("last-modified")[0]
+		objAuthor := fmt.Sprintf("%v | %v", getFileSize(info.Size), info.ContentType)
+		objProvider := info.LastModified.Format(http.TimeFormat)
 
-		if strings.HasPrefix(contentTypeHeader, "image") {
+		if strings.HasPrefix(info.ContentType, "image") {
 			objType = "photo"
-		} else if strings.HasPrefix(contentTypeHeader, "video") {
+		} else if strings.HasPrefix(info.ContentType, "video") {
 			objType = "video"
 		} else {
 			objType = "link"
@@ -82,20 +87,14 @@ func getOGEmbedRoute(ctx *fiber.Ctx) error {
 
 		return ctx.JSON(jsonObj)
 	} else {
-		return ctx.Redirect(imageURL, fiber.StatusMovedPermanently)
+		return ctx.Redirect(rawFileURL(file), fiber.StatusMovedPermanently)
 	}
 }
 
 func uploadFileRoute(ctx *fiber.Ctx) error {
-	s, err := session.NewSession(cdnS3Config)
-	if err != nil {
-		respErr := NewResponseByError(fiber.StatusBadRequest, err)
-		return ctx.JSON(respErr)
-	}
-
-	file, respErr := UploadFile(s, ctx)
+	file, respErr := UploadFile(ctx)
 	if respErr != nil {
-		return ctx.JSON(respErr)
+		return sendUploadError(ctx, respErr)
 	}
 
 	url := fmt.Sprintf("%v/%v", cdnConfig.CdnEndpoint, file)
@@ -110,7 +109,7 @@ func uploadFileRoute(ctx *fiber.Ctx) error {
 }
 
 func getFileRoute(ctx *fiber.Ctx) error {
-	key := ctx.Params("id")
+	key := ctx.Params("file")
 
 	fmt.Println("Endpoint Hit: getImage")
 
@@ -120,38 +119,42 @@ func getFileRoute(ctx *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, queryErr.Error())
 	}
 
-	imageURL := fmt.Sprintf("%s/%s", cdnConfig.SpacesConfig.SpacesUrl, key)
+	imageURL := rawFileURL(key)
 	oembedURL := fmt.Sprintf("%s/oembed/%s", cdnConfig.CdnEndpoint, key)
-	res, err := http.Head(imageURL)
+	file, err := fileAvailable(ctx.Context(), key)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		return storageError(err)
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return fiber.NewError(res.StatusCode, "An error occurred redirecting to the image")
+	info, err := cdnStorage.Head(ctx.Context(), key)
+	if err != nil {
+		return storageError(err)
 	}
 
-	if queries.Download == "true" {
-		ctx.Set("Content-Type", res.Header.Values("content-type")[0])
-		ctx.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, key))
-		ctx.Set("Content-Length", fmt.Sprintf("%v", res.ContentLength))
-
-		resp, err := http.Get(imageURL)
-		if err != nil {
-			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-		}
+	proxied := file != nil && file.proxied()
 
-		defer resp.Body.Close()
-
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-		}
+	if file != nil && file.Private && !validFileLink(ctx, key) {
+		return fiber.NewError(fiber.StatusForbidden, "This file is private, a valid link is needed to open it.")
+	}
 
-		return ctx.Send(body)
+	if file != nil && file.PasswordHash != "" && !fileUnlocked(ctx, file) {
+		return sendPasswordPrompt(ctx, key, false)
 	}
 
-	if ctx.Get("User-Agent") == "Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)" {
+	if proxied && isPreviewBot(ctx) {
+		// a preview would use up a download or give away a protected file, so bots only get the name
+		ctx.Type("html")
+		return ctx.Send([]byte(fmt.Sprintf(
+			`<!DOCTYPE html>
+			<html>
+				<head>
+					<meta name="theme-color" content="#dd9323">
+					<meta property="og:title" content="%v">
+				</head>
+			</html>`,
+			key)),
+		)
+	} else if isPreviewBot(ctx) {
 		ctx.Type("html")
 		return ctx.Send([]byte(fmt.Sprintf(
 			`<!DOCTYPE html>
@@ -165,46 +168,115 @@ func getFileRoute(ctx *fiber.Ctx) error {
 			</html>`,
 			key, imageURL, oembedURL)),
 		)
+	} else if queries.Download == "true" {
+		return sendFile(ctx, file, info, true)
+	} else if file != nil && file.Private {
+		return sendPrivateFile(ctx, file, info, false)
+	} else if queries.Raw == "true" || proxied || cdnStorage.PublicURL(key) == "" {
+		return sendFile(ctx, file, info, false)
 	} else {
 		return ctx.Redirect(imageURL, fiber.StatusMovedPermanently)
 	}
 }
 
+// the url the raw file can be fetched from, going through the cdn when storage has no public url
+func rawFileURL(key string) string {
+	if url := cdnStorage.PublicURL(key); url != "" {
+		return url
+	}
+
+	return fmt.Sprintf("%v/%v?raw=true", cdnConfig.CdnEndpoint, key)
+}
+
+// parts of the user agents of apps that fetch links to show a preview of them, in lower case.
+// iMessage sends one with facebookexternalhit and Twitterbot in it
+var previewBots = []string{
+	"discordbot",
+	"slackbot",
+	"slack-imgproxy",
+	"telegrambot",
+	"twitterbot",
+	"facebookexternalhit",
+	"facebot",
+	"whatsapp",
+	"linkedinbot",
+	"skypeuripreview",
+	"mattermost-bot",
+	"redditbot",
+	"mastodon",
+	"discourse forum onebox",
+	"embedly",
+	"iframely",
+	"vkshare",
+	"pinterest",
+}
+
+// whether the request comes from an app showing a preview of the link rather than someone opening it
+func isPreviewBot(ctx *fiber.Ctx) bool {
+	agent := strings.ToLower(ctx.Get("User-Agent"))
+
+	for _, bot := range previewBots {
+		if strings.Contains(agent, bot) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// converts a storage error into a fiber error
+func storageError(err error) error {
+	if err == ErrObjectNotFound || err == ErrRecordNotFound {
+		return fiber.NewError(fiber.StatusNotFound, "File not found.")
+	}
+
+	if err == ErrFileExpired {
+		return fiber.NewError(fiber.StatusGone, "File is no longer available.")
+	}
+
+	return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+}
+
 func getFilesRoute(ctx *fiber.Ctx) error {
-	s, err := session.NewSession(cdnS3Config)
-	if err != nil {
+	query := new(FilesQuery)
+
+	if err := ctx.QueryParser(query); err != nil {
 		respErr := NewResponseByError(fiber.StatusBadRequest, err)
 		return ctx.JSON(respErr)
 	}
 
-	objects, objectsErr := GetFiles(s)
-	if objectsErr != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, objectsErr.Error())
+	if respErr := query.Validate(); respErr != nil {
+		return ctx.JSON(respErr)
 	}
 
-	data := fiber.Map{
-		"files":  objects,
-		"length": len(objects),
+	if user := currentUser(ctx); !user.Admin {
+		query.Owner = user.UID
 	}
 
-	return ctx.JSON(data)
+	result, err := ListFiles(ctx.Context(), query)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	return ctx.JSON(result)
 }
 
 func deleteFileRoute(ctx *fiber.Ctx) error {
 	id := ctx.Params("id")
-	s, err := session.NewSession(cdnS3Config)
-	if err != nil {
-		respErr := NewResponseByError(fiber.StatusBadRequest, err)
-		return ctx.JSON(respErr)
-	}
 
-	respErr := DeleteFile(s, id)
+	folders, respErr := DeleteFile(ctx.Context(), currentUser(ctx), id)
 	if respErr != nil {
 		return ctx.JSON(respErr)
 	}
 
+	if folders == nil {
+		folders = make([]string, 0)
+	}
+
 	return ctx.JSON(fiber.Map{
 		"id":      id,
+		"folders": folders,
+		"trashed": trashEnabled(),
 		"success": true,
 		"code":    200,
 	})
@@ -223,7 +295,7 @@ func createFolderRoute(ctx *fiber.Ctx) error {
 		return ctx.JSON(respErr)
 	}
 
-	folder, respErr := NewFolder(body.Name)
+	folder, respErr := NewFolder(ctx.Context(), body.Name, currentUser(ctx).UID)
 	if respErr != nil {
 		return ctx.JSON(respErr)
 	}
@@ -233,49 +305,50 @@ func createFolderRoute(ctx *fiber.Ctx) error {
 		UpdateTime: folder.UpdateTime,
 		ID:         folder.Data.ID,
 		Name:       folder.Data.Name,
+		Owner:      folder.Data.Owner,
 	})
 }
 
 func getFoldersRoute(ctx *fiber.Ctx) error {
-	firebaseCtx := context.Background()
-	docs, err := cdnFirestore.Collection("folders").Documents(firebaseCtx).GetAll()
+	docs, err := cdnMetadata.ListFolders(ctx.Context())
 	if err != nil {
 		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
 		return ctx.JSON(respErr)
 	}
 
-	folders := make([]*FoldersResult, len(docs))
-	for i, doc := range docs {
-		data := new(FolderData)
-		doc.DataTo(data)
+	user := currentUser(ctx)
 
-		folders[i] = &FoldersResult{
-			CreateTime: doc.CreateTime,
-			UpdateTime: doc.UpdateTime,
-			ID:         data.ID,
-			Name:       data.Name,
-			Size:       len(data.Files),
+	folders := make([]*FoldersResult, 0, len(docs))
+	for _, folder := range docs {
+		if folder.Data.Deleted == nil && user.owns(folder.Data.Owner) {
+			folders = append(folders, NewFoldersResult(folder))
 		}
 	}
 
 	return ctx.JSON(folders)
 }
 
+func NewFoldersResult(folder *Folder) *FoldersResult {
+	return &FoldersResult{
+		CreateTime: folder.CreateTime,
+		UpdateTime: folder.UpdateTime,
+		ID:         folder.Data.ID,
+		Name:       folder.Data.Name,
+		Owner:      folder.Data.Owner,
+		Size:       len(folder.Data.Files),
+		Deleted:    folder.Data.Deleted,
+	}
+}
+
 func getFolderRoute(ctx *fiber.Ctx) error {
 	id := ctx.Params("id")
-	folder, respErr := FolderFor(id)
+	folder, respErr := FolderFor(ctx.Context(), id)
 
 	if respErr != nil {
 		return ctx.JSON(respErr)
 	}
 
-	s, err := session.NewSession(cdnS3Config)
-	if err != nil {
-		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
-		return ctx.JSON(respErr)
-	}
-
-	files, err := GetFilesByKeys(s, folder.Data.Files)
+	files, err := GetFilesByKeys(ctx.Context(), folder.Data.Files, folder.Data.Owner)
 	if err != nil {
 		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
 		return ctx.JSON(respErr)
@@ -286,6 +359,7 @@ func getFolderRoute(ctx *fiber.Ctx) error {
 		UpdateTime: folder.UpdateTime,
 		ID:         folder.Data.ID,
 		Name:       folder.Data.Name,
+		Owner:      folder.Data.Owner,
 		Files:      files,
 	})
 }
@@ -299,16 +373,24 @@ func updateFolderRoute(ctx *fiber.Ctx) error {
 	}
 
 	id := ctx.Params("id")
-	folder, respErr := FolderFor(id)
+	folder, respErr := FolderFor(ctx.Context(), id)
 	if respErr != nil {
 		return ctx.JSON(respErr)
 	}
 
+	if respErr := folder.CheckOwner(currentUser(ctx)); respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
 	if body.Name != "" {
-		folder.Data.Name = body.Name
+		folder.SetName(body.Name)
 	}
 
 	if body.Add != nil {
+		if respErr := folder.CheckFilesOwned(ctx.Context(), currentUser(ctx), body.Add); respErr != nil {
+			return ctx.JSON(respErr)
+		}
+
 		folder.AddFiles(body.Add, false)
 	}
 
@@ -317,7 +399,7 @@ func updateFolderRoute(ctx *fiber.Ctx) error {
 	}
 
 	if folder.IsChanged() {
-		if respErr := folder.Save(); respErr != nil {
+		if respErr := folder.Save(ctx.Context()); respErr != nil {
 			return ctx.JSON(respErr)
 		}
 	}
@@ -327,18 +409,23 @@ func updateFolderRoute(ctx *fiber.Ctx) error {
 		UpdateTime: folder.UpdateTime,
 		ID:         folder.Data.ID,
 		Name:       folder.Data.Name,
+		Owner:      folder.Data.Owner,
 	})
 }
 
 func deleteFolderRoute(ctx *fiber.Ctx) error {
 	id := ctx.Params("id")
 
-	folder, respErr := FolderFor(id)
+	folder, respErr := FolderFor(ctx.Context(), id)
 	if respErr != nil {
 		return ctx.JSON(respErr)
 	}
 
-	respErr = folder.Delete()
+	if respErr := folder.CheckOwner(currentUser(ctx)); respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	respErr = folder.Delete(ctx.Context())
 	if respErr != nil {
 		return ctx.JSON(respErr)
 	}
@@ -348,5 +435,6 @@ func deleteFolderRoute(ctx *fiber.Ctx) error {
 		UpdateTime: folder.UpdateTime,
 		ID:         folder.Data.ID,
 		Name:       folder.Data.Name,
+		Owner:      folder.Data.Owner,
 	})
 }
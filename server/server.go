@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/auth"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/joho/godotenv"
@@ -19,10 +21,21 @@ import (
 var cdnApp *firebase.App
 var cdnAuth *auth.Client
 var cdnFirestore *firestore.Client
-var cdnS3Config *aws.Config
+var cdnStorage Storage
+var cdnMetadata MetadataStore
 var cdnConfig *Config
 
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	startTusCleanUp()
+	startPresignCleanUp()
+	startTrashPurger()
+	startExpiryPurger()
+	startReconcile()
 	setUpRoutes()
 }
 
@@ -42,14 +55,56 @@ func init() {
 			SpacesCdn:       os.Getenv("SPACES_CDN_URL"),
 			SpacesName:      os.Getenv("SPACES_NAME"),
 			SpacesRegion:    os.Getenv("SPACES_REGION"),
+
+			MultipartThreshold:   envInt64("MULTIPART_THRESHOLD", 64*1024*1024),
+			MultipartPartSize:    envInt64("MULTIPART_PART_SIZE", 16*1024*1024),
+			MultipartConcurrency: int(envInt64("MULTIPART_CONCURRENCY", 4)),
+			MaxConnections:       int(envInt64("SPACES_MAX_CONNECTIONS", 64)),
 		},
-		CdnEndpoint:   os.Getenv("CDN_ENDPOINT"),
-		Authorization: os.Getenv("AUTHORIZATION"),
-		Production:    os.Getenv("PRODUCTION") != "false",
+		CdnEndpoint:      os.Getenv("CDN_ENDPOINT"),
+		Authorization:    os.Getenv("AUTHORIZATION"),
+		Production:       os.Getenv("PRODUCTION") != "false",
+		StorageDriver:    os.Getenv("STORAGE_DRIVER"),
+		LocalStoragePath: os.Getenv("LOCAL_STORAGE_PATH"),
+		MetadataDriver:   os.Getenv("METADATA_DRIVER"),
+		MetadataPath:     os.Getenv("METADATA_PATH"),
+		BodyLimit:        int(envInt64("BODY_LIMIT", fiber.DefaultBodyLimit)),
+		MaxUploadSize:    envInt64("MAX_UPLOAD_SIZE", 5*1024*1024*1024),
+		TusPath:          os.Getenv("TUS_PATH"),
+		ObjectCacheSize:  int(envInt64("OBJECT_CACHE_SIZE", 10000)),
+		ObjectCacheTTL:   time.Duration(envInt64("OBJECT_CACHE_TTL", 300)) * time.Second,
+
+		SigningKey:   []byte(os.Getenv("SIGNING_KEY")),
+		FirebaseAuth: os.Getenv("FIREBASE_AUTH") == "true",
+
+		DefaultQuota: Quota{
+			Bytes:         envInt64("QUOTA_BYTES", 0),
+			Files:         envInt64("QUOTA_FILES", 0),
+			FileSize:      envInt64("QUOTA_FILE_SIZE", 0),
+			UploadsPerDay: envInt64("QUOTA_UPLOADS_PER_DAY", 0),
+		},
+		TrashRetention: time.Duration(envInt64("TRASH_RETENTION_DAYS", 30)) * 24 * time.Hour,
+
+		ReconcileInterval:      time.Duration(envInt64("RECONCILE_INTERVAL", 0)) * time.Minute,
+		ReconcileDryRun:        os.Getenv("RECONCILE_DRY_RUN") == "true",
+		ReconcileDeleteOrphans: os.Getenv("RECONCILE_DELETE_ORPHANS") == "true",
 	}
 
-	if cdnConfig.Authorization == "" {
-		log.Fatal("No Authorization token provided, closing...")
+	if cdnConfig.SpacesConfig.MultipartPartSize < minPartSize {
+		log.Fatalf("MULTIPART_PART_SIZE can't be lower than %v bytes, closing...", minPartSize)
+	}
+
+	if cdnConfig.TusPath == "" {
+		cdnConfig.TusPath = filepath.Join(os.TempDir(), "cdn-tus")
+	}
+
+	// without AUTHORIZATION there is nothing to derive the signing key from, api keys are used instead
+	if len(cdnConfig.SigningKey) == 0 {
+		if cdnConfig.Authorization == "" {
+			log.Fatal("No SIGNING_KEY provided, it's required when AUTHORIZATION isn't set, closing...")
+		}
+
+		cdnConfig.SigningKey = defaultSigningKey(cdnConfig.Authorization)
 	}
 
 	mode := "DEVELOPMENT"
@@ -58,23 +113,57 @@ func init() {
 	}
 	log.Printf("Starting in %v mode", mode)
 
-	cdnS3Config = &aws.Config{
-		Credentials: credentials.NewStaticCredentials(cdnConfig.SpacesConfig.SpacesAccessKey, cdnConfig.SpacesConfig.SpacesSecretKey, ""),
-		Endpoint:    aws.String(cdnConfig.SpacesConfig.SpacesEndpoint),
-		Region:      aws.String(cdnConfig.SpacesConfig.SpacesRegion),
+	setUpStorage()
+
+	// firebase is only needed when folders are kept in firestore or users sign in with it
+	if cdnConfig.MetadataDriver == "firestore" || cdnConfig.FirebaseAuth {
+		setUpFirebase()
+	}
+
+	if cdnConfig.MetadataDriver == "firestore" {
+		setUpFirebaseFirestore()
 	}
 
-	setUpFirebase()
-	setUpFirebaseFirestore()
-	setUpFirebaseAuth()
+	if cdnConfig.FirebaseAuth {
+		setUpFirebaseAuth()
+	}
+
+	setUpMetadata()
+}
+
+// reads a number from the environment, falling back when it's not set
+func envInt64(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	num, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid value for %v: %v", key, err)
+	}
+
+	return num
 }
 
 func setUpRoutes() {
-	server := fiber.New()
+	server := fiber.New(fiber.Config{
+		BodyLimit: cdnConfig.BodyLimit,
+		// bodies are streamed so uploads can be stored as they're received, see limitBody
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	})
+
+	server.Use(limitBody)
 
 	server.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowHeaders: "Origin, Content-Type, Accept, User-Agent",
+		// plain OPTIONS requests are tus discovery requests and not preflights
+		Next: func(ctx *fiber.Ctx) bool {
+			return ctx.Method() == fiber.MethodOptions && ctx.Get("Access-Control-Request-Method") == ""
+		},
+		AllowOrigins:  "*",
+		AllowHeaders:  "Origin, Content-Type, Accept, User-Agent, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset",
+		ExposeHeaders: "Content-Range, Accept-Ranges, ETag, Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires",
 	}))
 
 	if cdnConfig.Production {
@@ -82,34 +171,132 @@ func setUpRoutes() {
 	}
 
 	server.Get("/:file", getFileRoute)
+	server.Post("/:file", unlockLimiter(), unlockFileRoute)
 	server.Get("/oembed/:file", getOGEmbedRoute)
 
 	api := server.Group("/api")
 
-	// api.Get("/user", authorize, getUserRoute) // auth
-	// api.Post("/user", createUserRoute) // auth
-	// api.Get("/ws", authorize, getWebSocket) // auth
-	api.Post("/verify", verifyAuthRoute) // auth
+	api.Get("/user", authorize(scopeRead), getUserRoute) // auth
+	api.Post("/user", createUserRoute)
+	// api.Get("/ws", authorize(scopeRead), getWebSocket) // auth
+	api.Post("/verify", verifyAuthRoute)                   // auth
+	api.Get("/usage", authorize(scopeRead), getUsageRoute) // auth
+
+	// users, only for admins
+	api.Get("/users", authorize(scopeAdmin), adminOnly, getUsersRoute)              // auth
+	api.Post("/users", authorize(scopeAdmin), adminOnly, createUsersRoute)          // auth
+	api.Patch("/users/:id", authorize(scopeAdmin), adminOnly, updateUserRoute)      // auth
+	api.Delete("/users/:id", authorize(scopeAdmin), adminOnly, deleteUserRoute)     // auth
+	api.Get("/invites", authorize(scopeAdmin), adminOnly, getInvitesRoute)          // auth
+	api.Post("/invites", authorize(scopeAdmin), adminOnly, createInviteRoute)       // auth
+	api.Delete("/invites/:id", authorize(scopeAdmin), adminOnly, revokeInviteRoute) // auth
+
+	// api keys
+	api.Get("/keys", authorize(scopeAdmin), getKeysRoute)          // auth
+	api.Post("/keys", authorize(scopeAdmin), createKeyRoute)       // auth
+	api.Delete("/keys/:id", authorize(scopeAdmin), revokeKeyRoute) // auth
 
 	// files
-	api.Post("/upload", authorize, uploadFileRoute)      // auth
-	api.Get("/files", authorize, getFilesRoute)          // auth
-	api.Delete("/files/:id", authorize, deleteFileRoute) // auth
+	api.Post("/upload", authorize(scopeUpload), uploadFileRoute)              // auth
+	api.Post("/upload/presign", authorize(scopeUpload), presignUploadRoute)   // auth
+	api.Post("/upload/complete", authorize(scopeUpload), completeUploadRoute) // auth
+	api.Get("/files", authorize(scopeRead), getFilesRoute)                    // auth
+	api.Delete("/files/:id", authorize(scopeDelete), deleteFileRoute)         // auth
+	api.Post("/files/:id/link", authorize(scopeRead), createFileLinkRoute)    // auth
+
+	// resumable uploads
+	api.Options("/tus", tusHeaders, tusOptionsRoute)
+	api.Post("/tus", authorize(scopeUpload), tusHeaders, createTusUploadRoute)       // auth
+	api.Head("/tus/:id", authorize(scopeUpload), tusHeaders, getTusUploadRoute)      // auth
+	api.Patch("/tus/:id", authorize(scopeUpload), tusHeaders, patchTusUploadRoute)   // auth
+	api.Delete("/tus/:id", authorize(scopeUpload), tusHeaders, deleteTusUploadRoute) // auth
 
 	// folders
-	api.Get("/folders", authorize, getFoldersRoute)    // auth
-	api.Post("/folders", authorize, createFolderRoute) // auth
+	api.Get("/folders", authorize(scopeRead), getFoldersRoute)            // auth
+	api.Post("/folders", authorize(scopeFoldersWrite), createFolderRoute) // auth
 	api.Get("/folders/:id", getFolderRoute)
-	api.Patch("/folders/:id", authorize, updateFolderRoute)  // auth
-	api.Delete("/folders/:id", authorize, deleteFolderRoute) // auth
+	api.Patch("/folders/:id", authorize(scopeFoldersWrite), updateFolderRoute)  // auth
+	api.Delete("/folders/:id", authorize(scopeFoldersWrite), deleteFolderRoute) // auth
+
+	// trash
+	api.Get("/trash", authorize(scopeRead), getTrashRoute)                                   // auth
+	api.Delete("/trash", authorize(scopeDelete), emptyTrashRoute)                            // auth
+	api.Post("/trash/files/:id/restore", authorize(scopeDelete), restoreFileRoute)           // auth
+	api.Delete("/trash/files/:id", authorize(scopeDelete), purgeFileRoute)                   // auth
+	api.Post("/trash/folders/:id/restore", authorize(scopeFoldersWrite), restoreFolderRoute) // auth
+	api.Delete("/trash/folders/:id", authorize(scopeFoldersWrite), purgeFolderRoute)         // auth
 
 	log.Fatal(server.Listen(":3000"))
 }
 
+// streamed bodies are read into memory up to BODY_LIMIT for every route but /api/upload,
+// which stores the file as it's received and is only limited by MAX_UPLOAD_SIZE
+func limitBody(ctx *fiber.Ctx) error {
+	if !ctx.Request().IsBodyStream() || (ctx.Method() == fiber.MethodPost && ctx.Path() == "/api/upload") {
+		return ctx.Next()
+	}
+
+	if ctx.Request().Header.ContentLength() > cdnConfig.BodyLimit {
+		return fiber.ErrRequestEntityTooLarge
+	}
+
+	body, err := io.ReadAll(io.LimitReader(ctx.Request().BodyStream(), int64(cdnConfig.BodyLimit)+1))
+	if err != nil {
+		return fiber.ErrBadRequest
+	} else if len(body) > cdnConfig.BodyLimit {
+		return fiber.ErrRequestEntityTooLarge
+	}
+
+	ctx.Request().SetBodyRaw(body)
+	return ctx.Next()
+}
+
+func setUpStorage() {
+	storage, err := NewStorage(cdnConfig)
+	if err != nil {
+		log.Printf("Could not set up storage")
+		log.Fatal(err)
+		return
+	}
+
+	cdnStorage = storage
+	if cdnConfig.ObjectCacheSize > 0 {
+		cdnStorage = NewCachedStorage(storage, cdnConfig.ObjectCacheSize, cdnConfig.ObjectCacheTTL)
+	}
+
+	driver := cdnConfig.StorageDriver
+	if driver == "" {
+		driver = "spaces"
+	}
+	log.Printf("Using %v storage", driver)
+}
+
+func setUpMetadata() {
+	store, err := NewMetadataStore(cdnConfig)
+	if err != nil {
+		log.Printf("Could not set up metadata store")
+		log.Fatal(err)
+		return
+	}
+
+	cdnMetadata = store
+
+	driver := cdnConfig.MetadataDriver
+	if driver == "" {
+		driver = "bolt"
+	}
+	log.Printf("Using %v metadata store", driver)
+}
+
 func setUpFirebase() {
 	options := option.WithCredentialsFile("service-account.json")
 	ctx := context.Background()
 
+	// the auth emulator doesn't need credentials, so a service account is optional when using it
+	if _, err := os.Stat("service-account.json"); os.IsNotExist(err) && os.Getenv("FIREBASE_AUTH_EMULATOR_HOST") != "" {
+		options = option.WithoutAuthentication()
+	}
+
 	fbApp, err := firebase.NewApp(ctx, nil, options)
 	cdnApp = fbApp
 
@@ -137,6 +324,11 @@ func setUpFirebaseFirestore() {
 }
 
 func setUpFirebaseAuth() {
+	// the emulator accepts unsigned tokens, so a stray variable must never reach production
+	if cdnConfig.Production && os.Getenv("FIREBASE_AUTH_EMULATOR_HOST") != "" {
+		log.Fatal("FIREBASE_AUTH_EMULATOR_HOST can't be used in production")
+	}
+
 	ctx := context.Background()
 	fbAuth, err := cdnApp.Auth(ctx)
 	cdnAuth = fbAuth
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// signs the parts with the signing key so they can be handed out and checked when they come back
+func sign(parts ...string) string {
+	mac := hmac.New(sha256.New, cdnConfig.SigningKey)
+	mac.Write([]byte(strings.Join(parts, "\n")))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validSignature(signature string, parts ...string) bool {
+	return hmac.Equal([]byte(signature), []byte(sign(parts...)))
+}
+
+// the key used when SIGNING_KEY isn't set, changing the authorization token then invalidates every signature
+func defaultSigningKey(authorization string) []byte {
+	key := sha256.Sum256([]byte("cdn signing key\n" + authorization))
+	return key[:]
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+// a backend that file objects are stored in
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader, opts *PutOptions) error
+	// gets the whole object or only the given range of it
+	Get(ctx context.Context, key string, rng *ByteRange) (io.ReadCloser, *ObjectInfo, error)
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// changes whether the object is publicly readable
+	SetPrivate(ctx context.Context, key string, private bool) error
+	List(ctx context.Context, opts *ListOptions) (*ListPage, error)
+
+	// the url objects can be fetched from directly, empty if they have to be served by us
+	PublicURL(key string) string
+}
+
+// implemented by backends that clients can upload to directly
+type PresignedStorage interface {
+	// returns a url the object can be PUT to and the headers that have to be sent with it
+	PresignPut(key string, opts *PutOptions, expires time.Duration) (string, http.Header, error)
+	// returns a url the object can be fetched from even when it's private
+	PresignGet(key string, expires time.Duration) (string, error)
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+	ETag         string
+}
+
+// a range of bytes in an object
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+type PutOptions struct {
+	Size        int64
+	ContentType string
+	// keeps the object from being publicly readable, it can then only be fetched through the cdn
+	Private bool
+}
+
+type ListOptions struct {
+	Prefix string
+	Token  string
+	Limit  int
+}
+
+type ListPage struct {
+	Objects   []*ObjectInfo
+	NextToken string
+}
+
+// creates the storage backend chosen in the config
+func NewStorage(config *Config) (Storage, error) {
+	switch config.StorageDriver {
+	case "", "spaces":
+		return NewSpacesStorage(&config.SpacesConfig)
+	case "local":
+		return NewLocalStorage(config.LocalStoragePath)
+	}
+
+	return nil, fmt.Errorf("unknown storage driver %q", config.StorageDriver)
+}
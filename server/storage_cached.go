@@ -0,0 +1,138 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// wraps a storage backend and keeps the info of recently requested objects in memory,
+// so serving a hot file doesn't need a round trip to the backend every time
+type CachedStorage struct {
+	Storage
+	cache *ObjectCache
+}
+
+func NewCachedStorage(storage Storage, size int, ttl time.Duration) *CachedStorage {
+	return &CachedStorage{
+		Storage: storage,
+		cache:   NewObjectCache(size, ttl),
+	}
+}
+
+func (storage *CachedStorage) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	if info := storage.cache.Get(key); info != nil {
+		return info, nil
+	}
+
+	info, err := storage.Storage.Head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.cache.Add(info)
+	return info, nil
+}
+
+func (storage *CachedStorage) Put(ctx context.Context, key string, body io.Reader, opts *PutOptions) error {
+	storage.cache.Remove(key)
+	err := storage.Storage.Put(ctx, key, body, opts)
+	storage.cache.Remove(key)
+
+	return err
+}
+
+func (storage *CachedStorage) Delete(ctx context.Context, key string) error {
+	err := storage.Storage.Delete(ctx, key)
+	storage.cache.Remove(key)
+
+	return err
+}
+
+// gets the backend underneath any caching, used to check for optional features
+func unwrapStorage(storage Storage) Storage {
+	if cached, ok := storage.(*CachedStorage); ok {
+		return cached.Storage
+	}
+
+	return storage
+}
+
+// a size bounded least recently used cache of object info where entries expire after the ttl
+type ObjectCache struct {
+	size    int
+	ttl     time.Duration
+	lock    sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type objectCacheEntry struct {
+	info    *ObjectInfo
+	expires time.Time
+}
+
+func NewObjectCache(size int, ttl time.Duration) *ObjectCache {
+	return &ObjectCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (cache *ObjectCache) Get(key string) *ObjectInfo {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*objectCacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil
+	}
+
+	cache.order.MoveToFront(element)
+	return entry.info
+}
+
+func (cache *ObjectCache) Add(info *ObjectInfo) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry := &objectCacheEntry{
+		info:    info,
+		expires: time.Now().Add(cache.ttl),
+	}
+
+	if element, ok := cache.entries[info.Key]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[info.Key] = cache.order.PushFront(entry)
+
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*objectCacheEntry).info.Key)
+	}
+}
+
+func (cache *ObjectCache) Remove(key string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+	}
+}
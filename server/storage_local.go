@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// stores objects as plain files in a directory, useful for running without a bucket
+type LocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	if root == "" {
+		root = "files"
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &LocalStorage{root: root}, nil
+}
+
+// resolves a key to a path, refusing anything that escapes the root
+func (storage *LocalStorage) path(key string) (string, error) {
+	cleaned := filepath.Clean("/" + key)
+	if key == "" || cleaned == "/" || strings.HasPrefix(filepath.Base(cleaned), ".") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+
+	return filepath.Join(storage.root, filepath.FromSlash(cleaned)), nil
+}
+
+func (storage *LocalStorage) Put(ctx context.Context, key string, body io.Reader, opts *PutOptions) error {
+	path, err := storage.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a failed upload never leaves a partial object behind
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if opts.Size >= 0 && written != opts.Size {
+		return fmt.Errorf("expected %v bytes but wrote %v", opts.Size, written)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (storage *LocalStorage) Get(ctx context.Context, key string, rng *ByteRange) (io.ReadCloser, *ObjectInfo, error) {
+	path, err := storage.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, localError(err)
+	}
+
+	info, err := storage.info(key, file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if rng == nil {
+		return file, info, nil
+	}
+
+	if _, err := file.Seek(rng.Start, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return &limitedFile{io.LimitReader(file, rng.Length), file}, info, nil
+}
+
+// reads part of a file while still closing the whole file
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+func (storage *LocalStorage) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	path, err := storage.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, localError(err)
+	}
+
+	defer file.Close()
+
+	return storage.info(key, file)
+}
+
+// stats the file and sniffs its content type, leaving the file positioned at the start
+func (storage *LocalStorage) info(key string, file *os.File) (*ObjectInfo, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  contentType,
+		LastModified: stat.ModTime().UTC(),
+		ETag:         fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()),
+	}, nil
+}
+
+func (storage *LocalStorage) Delete(ctx context.Context, key string) error {
+	path, err := storage.path(key)
+	if err != nil {
+		return err
+	}
+
+	return localError(os.Remove(path))
+}
+
+// local objects are never public, so there's nothing to change as long as the object exists
+func (storage *LocalStorage) SetPrivate(ctx context.Context, key string, private bool) error {
+	path, err := storage.path(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(path)
+	return localError(err)
+}
+
+// lists objects in key order, the token is the last key of the previous page
+func (storage *LocalStorage) List(ctx context.Context, opts *ListOptions) (*ListPage, error) {
+	var keys []string
+
+	err := filepath.Walk(storage.root, func(path string, stat os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(stat.Name(), ".") && path != storage.root {
+			if stat.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if stat.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(storage.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, opts.Prefix) && key > opts.Token {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+
+	page := new(ListPage)
+	if opts.Limit > 0 && len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+		page.NextToken = keys[len(keys)-1]
+	}
+
+	for _, key := range keys {
+		info, err := storage.Head(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Objects = append(page.Objects, info)
+	}
+
+	return page, nil
+}
+
+// local objects have no public url and are always served by the cdn itself
+func (storage *LocalStorage) PublicURL(key string) string {
+	return ""
+}
+
+func localError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+
+	return err
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// stores objects in a DigitalOcean Spaces bucket.
+// a single client is shared by every request, it's safe to use concurrently and keeps connections alive
+type SpacesStorage struct {
+	config *SpacesConfig
+	client *s3.S3
+}
+
+func NewSpacesStorage(config *SpacesConfig) (*SpacesStorage, error) {
+	awsConfig := spacesAWSConfig(config)
+	awsConfig.HTTPClient = &http.Client{Transport: spacesTransport(config)}
+
+	s, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SpacesStorage{
+		config: config,
+		client: s3.New(s),
+	}, nil
+}
+
+func spacesAWSConfig(config *SpacesConfig) *aws.Config {
+	return &aws.Config{
+		Credentials: credentials.NewStaticCredentials(config.SpacesAccessKey, config.SpacesSecretKey, ""),
+		Endpoint:    aws.String(config.SpacesEndpoint),
+		Region:      aws.String(config.SpacesRegion),
+	}
+}
+
+// the default transport only keeps two idle connections per host, which means
+// reconnecting all the time once a few requests run at the same time
+func spacesTransport(config *SpacesConfig) *http.Transport {
+	connections := config.MaxConnections
+	if connections < 1 {
+		connections = 64
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          connections,
+		MaxIdleConnsPerHost:   connections,
+		MaxConnsPerHost:       connections,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// the body is streamed to the bucket, it has to be seekable so the request can be signed
+// unless the size is unknown
+func (storage *SpacesStorage) Put(ctx context.Context, key string, body io.Reader, opts *PutOptions) error {
+	if opts.Size < 0 {
+		return storage.putStream(ctx, key, body, opts)
+	}
+
+	if storage.config.MultipartThreshold > 0 && opts.Size >= storage.config.MultipartThreshold {
+		return storage.putMultipart(ctx, key, body, opts)
+	}
+
+	object := &s3.PutObjectInput{
+		Bucket:               aws.String(storage.config.SpacesName),
+		Key:                  aws.String(key),
+		ACL:                  aws.String(objectACL(opts)),
+		Body:                 aws.ReadSeekCloser(body),
+		ContentLength:        aws.Int64(opts.Size),
+		ContentType:          aws.String(opts.ContentType),
+		ServerSideEncryption: aws.String("AES256"),
+	}
+
+	_, err := storage.client.PutObjectWithContext(ctx, object)
+	return err
+}
+
+// puts a body of unknown size, the first part is read before deciding whether it needs more than one
+func (storage *SpacesStorage) putStream(ctx context.Context, key string, body io.Reader, opts *PutOptions) error {
+	first := make([]byte, storage.config.MultipartPartSize)
+
+	n, err := io.ReadFull(body, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		whole := *opts
+		whole.Size = int64(n)
+		return storage.Put(ctx, key, bytes.NewReader(first[:n]), &whole)
+	} else if err != nil {
+		return err
+	}
+
+	return storage.putMultipart(ctx, key, io.MultiReader(bytes.NewReader(first), body), opts)
+}
+
+// uploads the body in parts, aborting the upload if anything fails so no parts are left behind
+func (storage *SpacesStorage) putMultipart(ctx context.Context, key string, body io.Reader, opts *PutOptions) error {
+	created, err := storage.client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(storage.config.SpacesName),
+		Key:                  aws.String(key),
+		ACL:                  aws.String(objectACL(opts)),
+		ContentType:          aws.String(opts.ContentType),
+		ServerSideEncryption: aws.String("AES256"),
+	})
+	if err != nil {
+		return err
+	}
+
+	parts, err := storage.uploadParts(ctx, key, created.UploadId, body, opts.Size)
+	if err == nil {
+		_, err = storage.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(storage.config.SpacesName),
+			Key:             aws.String(key),
+			UploadId:        created.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+
+	if err != nil {
+		// the request context may already be cancelled, the abort still has to go through
+		storage.client.AbortMultipartUploadWithContext(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(storage.config.SpacesName),
+			Key:      aws.String(key),
+			UploadId: created.UploadId,
+		})
+
+		return err
+	}
+
+	return nil
+}
+
+type uploadPart struct {
+	number int64
+	size   int64
+	body   io.ReadSeeker
+}
+
+// the most parts a single upload can have
+const maxUploadParts = 10000
+
+// every part but the last has to be at least this big
+const minPartSize = 5 * 1024 * 1024
+
+// uploads the parts of the body in parallel, returning them in order. a size below 0 reads the body
+// until it ends
+func (storage *SpacesStorage) uploadParts(ctx context.Context, key string, uploadID *string, body io.Reader, size int64) ([]*s3.CompletedPart, error) {
+	partSize := storage.config.MultipartPartSize
+	if minimum := (size + maxUploadParts - 1) / maxUploadParts; partSize < minimum {
+		partSize = minimum
+	}
+
+	concurrency := storage.config.MultipartConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var partErr error
+	fail := func(err error) {
+		once.Do(func() {
+			partErr = err
+			cancel()
+		})
+	}
+
+	// the parts are only counted up front when the size is known
+	var mu sync.Mutex
+	completed := make(map[int64]*s3.CompletedPart)
+	parts := make(chan *uploadPart)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for part := range parts {
+				out, err := storage.client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+					Bucket:        aws.String(storage.config.SpacesName),
+					Key:           aws.String(key),
+					UploadId:      uploadID,
+					PartNumber:    aws.Int64(part.number),
+					Body:          part.body,
+					ContentLength: aws.Int64(part.size),
+				})
+				if err != nil {
+					fail(err)
+					continue
+				}
+
+				mu.Lock()
+				completed[part.number] = &s3.CompletedPart{
+					ETag:       out.ETag,
+					PartNumber: aws.Int64(part.number),
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// files can be read at any offset so the parts don't need to be buffered,
+	// anything else is read one part at a time which bounds memory to the concurrency
+	readerAt, canReadAt := body.(io.ReaderAt)
+	canReadAt = canReadAt && size >= 0
+
+	sent := int64(0)
+
+produce:
+	for number := int64(1); size < 0 || (number-1)*partSize < size; number++ {
+		if number > maxUploadParts {
+			fail(fmt.Errorf("upload has more than %v parts", maxUploadParts))
+			break
+		}
+
+		offset := (number - 1) * partSize
+		length := partSize
+		if size >= 0 && offset+length > size {
+			length = size - offset
+		}
+
+		last := false
+
+		var partBody io.ReadSeeker
+		if canReadAt {
+			partBody = io.NewSectionReader(readerAt, offset, length)
+		} else {
+			buffer := make([]byte, length)
+			n, err := io.ReadFull(body, buffer)
+			if size < 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+				// a body that ends on a part boundary has nothing left for another part
+				if n == 0 && number > 1 {
+					break
+				}
+
+				length = int64(n)
+				last = true
+			} else if err != nil {
+				fail(err)
+				break
+			}
+
+			partBody = bytes.NewReader(buffer[:length])
+		}
+
+		select {
+		case parts <- &uploadPart{number: number, size: length, body: partBody}:
+			sent = number
+		case <-ctx.Done():
+			break produce
+		}
+
+		if last {
+			break
+		}
+	}
+
+	close(parts)
+	wg.Wait()
+
+	if partErr != nil {
+		return nil, partErr
+	}
+
+	// the parent context was cancelled before every part was sent
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ordered := make([]*s3.CompletedPart, sent)
+	for number := int64(1); number <= sent; number++ {
+		ordered[number-1] = completed[number]
+	}
+
+	return ordered, nil
+}
+
+func objectACL(opts *PutOptions) string {
+	if opts.Private {
+		return "private"
+	}
+
+	return "public-read"
+}
+
+func (storage *SpacesStorage) PresignPut(key string, opts *PutOptions, expires time.Duration) (string, http.Header, error) {
+	req, _ := storage.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:               aws.String(storage.config.SpacesName),
+		Key:                  aws.String(key),
+		ACL:                  aws.String(objectACL(opts)),
+		ContentLength:        aws.Int64(opts.Size),
+		ContentType:          aws.String(opts.ContentType),
+		ServerSideEncryption: aws.String("AES256"),
+	})
+
+	return req.PresignRequest(expires)
+}
+
+func (storage *SpacesStorage) PresignGet(key string, expires time.Duration) (string, error) {
+	req, _ := storage.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(storage.config.SpacesName),
+		Key:    aws.String(key),
+	})
+
+	return req.Presign(expires)
+}
+
+func (storage *SpacesStorage) Get(ctx context.Context, key string, rng *ByteRange) (io.ReadCloser, *ObjectInfo, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(storage.config.SpacesName),
+		Key:    aws.String(key),
+	}
+
+	if rng != nil {
+		input.Range = aws.String(fmt.Sprintf("bytes=%v-%v", rng.Start, rng.Start+rng.Length-1))
+	}
+
+	out, err := storage.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, nil, spacesError(err)
+	}
+
+	size := aws.Int64Value(out.ContentLength)
+
+	// the content length is only the length of the range, the full size is after the slash
+	if contentRange := aws.StringValue(out.ContentRange); contentRange != "" {
+		if index := strings.LastIndex(contentRange, "/"); index != -1 {
+			if total, err := strconv.ParseInt(contentRange[index+1:], 10, 64); err == nil {
+				size = total
+			}
+		}
+	}
+
+	return out.Body, &ObjectInfo{
+		Key:          key,
+		Size:         size,
+		ContentType:  aws.StringValue(out.ContentType),
+		LastModified: aws.TimeValue(out.LastModified),
+		ETag:         aws.StringValue(out.ETag),
+	}, nil
+}
+
+func (storage *SpacesStorage) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	out, err := storage.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(storage.config.SpacesName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, spacesError(err)
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(out.ContentLength),
+		ContentType:  aws.StringValue(out.ContentType),
+		LastModified: aws.TimeValue(out.LastModified),
+		ETag:         aws.StringValue(out.ETag),
+	}, nil
+}
+
+func (storage *SpacesStorage) Delete(ctx context.Context, key string) error {
+	_, err := storage.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(storage.config.SpacesName),
+		Key:    aws.String(key),
+	})
+
+	return spacesError(err)
+}
+
+func (storage *SpacesStorage) SetPrivate(ctx context.Context, key string, private bool) error {
+	_, err := storage.client.PutObjectAclWithContext(ctx, &s3.PutObjectAclInput{
+		Bucket: aws.String(storage.config.SpacesName),
+		Key:    aws.String(key),
+		ACL:    aws.String(objectACL(&PutOptions{Private: private})),
+	})
+
+	return spacesError(err)
+}
+
+func (storage *SpacesStorage) List(ctx context.Context, opts *ListOptions) (*ListPage, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(storage.config.SpacesName),
+	}
+
+	if opts.Prefix != "" {
+		input.Prefix = aws.String(opts.Prefix)
+	}
+
+	if opts.Token != "" {
+		input.ContinuationToken = aws.String(opts.Token)
+	}
+
+	if opts.Limit > 0 {
+		input.MaxKeys = aws.Int64(int64(opts.Limit))
+	}
+
+	objects, err := storage.client.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	page := new(ListPage)
+	for _, obj := range objects.Contents {
+		page.Objects = append(page.Objects, &ObjectInfo{
+			Key:          aws.StringValue(obj.Key),
+			Size:         aws.Int64Value(obj.Size),
+			LastModified: aws.TimeValue(obj.LastModified),
+			ETag:         aws.StringValue(obj.ETag),
+		})
+	}
+
+	if aws.BoolValue(objects.IsTruncated) {
+		page.NextToken = aws.StringValue(objects.NextContinuationToken)
+	}
+
+	return page, nil
+}
+
+func (storage *SpacesStorage) PublicURL(key string) string {
+	return fmt.Sprintf("%v/%v", storage.config.SpacesUrl, key)
+}
+
+// maps the not found errors from the sdk onto ErrObjectNotFound
+func spacesError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrObjectNotFound
+		}
+	}
+
+	return err
+}
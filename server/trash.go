@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// deleted files and folders are kept in the trash for the retention period so they can be restored,
+// the purger deletes them for good afterwards. files stay in their folders until they're purged
+
+// whether deletes go to the trash, a retention of 0 deletes straight away
+func trashEnabled() bool {
+	return cdnConfig.TrashRetention > 0
+}
+
+// moves the file to the trash
+func TrashFile(ctx context.Context, file *File) *JSONResponse {
+	if file.Deleted != nil {
+		return nil
+	}
+
+	// the object must not stay publicly readable while it's in the trash
+	if err := cdnStorage.SetPrivate(ctx, file.ID, true); err != nil && err != ErrObjectNotFound {
+		return NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	now := time.Now().UTC()
+	file.Deleted = &now
+
+	if err := cdnMetadata.SaveFile(ctx, file); err != nil {
+		restoreACL(ctx, file)
+		return NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	return nil
+}
+
+func RestoreFile(ctx context.Context, user *User, key string) *JSONResponse {
+	file, respErr := trashedFile(ctx, key)
+	if respErr != nil {
+		return respErr
+	}
+
+	if respErr := file.CheckOwner(user); respErr != nil {
+		return respErr
+	}
+
+	file.Deleted = nil
+
+	if err := cdnMetadata.SaveFile(ctx, file); err != nil {
+		return NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	if err := restoreACL(ctx, file); err != nil {
+		return NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	return nil
+}
+
+// makes the object publicly readable again unless the file is only served through the cdn
+func restoreACL(ctx context.Context, file *File) error {
+	if file.proxied() {
+		return nil
+	}
+
+	err := cdnStorage.SetPrivate(ctx, file.ID, false)
+	if err != nil {
+		log.Printf("Failed to make %v public again: %v", file.ID, err)
+	}
+
+	return err
+}
+
+// gets the record of a file in the trash
+func trashedFile(ctx context.Context, key string) (*File, *JSONResponse) {
+	file, err := cdnMetadata.GetFile(ctx, key)
+	if err != nil && err != ErrRecordNotFound {
+		return nil, NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	if file == nil || file.Deleted == nil {
+		return nil, NewResponse(fiber.StatusNotFound, "File not in trash.")
+	}
+
+	return file, nil
+}
+
+// moves the folder to the trash
+func (folder *Folder) Trash(ctx context.Context) *JSONResponse {
+	now := time.Now().UTC()
+	folder.Data.Deleted = &now
+
+	folder.Updates = append(folder.Updates, Update{
+		Path:  "Deleted",
+		Value: folder.Data.Deleted,
+	})
+
+	return folder.Save(ctx)
+}
+
+func (folder *Folder) Restore(ctx context.Context) *JSONResponse {
+	folder.Data.Deleted = nil
+
+	folder.Updates = append(folder.Updates, Update{
+		Path:  "Deleted",
+		Value: nil,
+	})
+
+	return folder.Save(ctx)
+}
+
+// gets a folder in the trash
+func trashedFolder(ctx context.Context, id string) (*Folder, *JSONResponse) {
+	folder, err := cdnMetadata.GetFolder(ctx, id)
+	if err != nil && err != ErrRecordNotFound {
+		return nil, NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	if folder == nil || folder.Data.Deleted == nil {
+		return nil, NewResponse(fiber.StatusNotFound, "Folder not in trash.")
+	}
+
+	return folder, nil
+}
+
+// lists everything in the trash the user owns, most recently deleted first
+func ListTrash(ctx context.Context, user *User) (*TrashResult, error) {
+	now := time.Now()
+
+	files, err := cdnMetadata.ListTrashedFiles(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := cdnMetadata.ListTrashedFolders(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &TrashResult{
+		Files:   make([]*FileResult, 0),
+		Folders: make([]*FoldersResult, 0),
+	}
+
+	for _, file := range files {
+		if user.owns(file.Owner) {
+			result.Files = append(result.Files, NewFileResultFromRecord(file))
+		}
+	}
+
+	for _, folder := range folders {
+		if user.owns(folder.Data.Owner) {
+			result.Folders = append(result.Folders, NewFoldersResult(folder))
+		}
+	}
+
+	return result, nil
+}
+
+// deletes everything in the trash of the owner that was deleted before the time for good,
+// an empty owner purges the trash of everyone
+func PurgeTrash(ctx context.Context, owner string, before time.Time) (int, error) {
+	files, err := cdnMetadata.ListTrashedFiles(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+
+	folders, err := cdnMetadata.ListTrashedFolders(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+
+	for _, file := range files {
+		if owner == "" || file.Owner == owner {
+			if _, respErr := PurgeFile(ctx, file.ID); respErr != nil {
+				log.Printf("Failed to purge file %v from the trash: %v", file.ID, respErr.Message)
+				continue
+			}
+
+			purged++
+		}
+	}
+
+	for _, folder := range folders {
+		if owner == "" || folder.Data.Owner == owner {
+			if respErr := folder.Purge(ctx); respErr != nil {
+				log.Printf("Failed to purge folder %v from the trash: %v", folder.Data.ID, respErr.Message)
+				continue
+			}
+
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// purges expired items from the trash every hour
+func startTrashPurger() {
+	if !trashEnabled() {
+		return
+	}
+
+	go func() {
+		for {
+			purged, err := PurgeTrash(context.Background(), "", time.Now().Add(-cdnConfig.TrashRetention))
+			if err != nil {
+				log.Printf("Failed to purge trash: %v", err)
+			} else if purged > 0 {
+				log.Printf("Purged %v items from the trash", purged)
+			}
+
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func getTrashRoute(ctx *fiber.Ctx) error {
+	result, err := ListTrash(ctx.Context(), currentUser(ctx))
+	if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(result)
+}
+
+// empties the trash of the user, admins can empty the trash of someone else with the owner query parameter
+func emptyTrashRoute(ctx *fiber.Ctx) error {
+	user := currentUser(ctx)
+
+	owner := user.UID
+	if user.Admin && ctx.Query("owner") != "" {
+		owner = ctx.Query("owner")
+	}
+
+	purged, err := PurgeTrash(ctx.Context(), owner, time.Now())
+	if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(fiber.Map{
+		"purged":  purged,
+		"success": true,
+		"code":    200,
+	})
+}
+
+func restoreFileRoute(ctx *fiber.Ctx) error {
+	id := ctx.Params("id")
+
+	if respErr := RestoreFile(ctx.Context(), currentUser(ctx), id); respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(fiber.Map{
+		"id":      id,
+		"success": true,
+		"code":    200,
+	})
+}
+
+func purgeFileRoute(ctx *fiber.Ctx) error {
+	id := ctx.Params("id")
+
+	file, respErr := trashedFile(ctx.Context(), id)
+	if respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	if respErr := file.CheckOwner(currentUser(ctx)); respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	folders, respErr := PurgeFile(ctx.Context(), id)
+	if respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(fiber.Map{
+		"id":      id,
+		"folders": folders,
+		"success": true,
+		"code":    200,
+	})
+}
+
+func restoreFolderRoute(ctx *fiber.Ctx) error {
+	folder, respErr := trashedFolder(ctx.Context(), ctx.Params("id"))
+	if respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	if respErr := folder.CheckOwner(currentUser(ctx)); respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	if respErr := folder.Restore(ctx.Context()); respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(NewFoldersResult(folder))
+}
+
+func purgeFolderRoute(ctx *fiber.Ctx) error {
+	folder, respErr := trashedFolder(ctx.Context(), ctx.Params("id"))
+	if respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	if respErr := folder.CheckOwner(currentUser(ctx)); respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	if respErr := folder.Purge(ctx.Context()); respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(NewFoldersResult(folder))
+}
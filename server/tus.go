@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// resumable uploads following the tus 1.0 protocol, see https://tus.io/protocols/resumable-upload.html
+// chunks are staged on disk and the finished file is moved into storage like any other upload
+
+const tusVersion = "1.0.0"
+
+// how long an unfinished upload is kept around
+const tusExpiry = 24 * time.Hour
+
+type TusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	FileName string            `json:"file_name"`
+	Owner    string            `json:"owner"`
+	Metadata map[string]string `json:"metadata"`
+	Created  time.Time         `json:"created"`
+}
+
+// uploads currently being written to, another PATCH or a DELETE of the same upload is rejected
+var tusBusy = make(map[string]bool)
+var tusBusyLock sync.Mutex
+
+// marks the upload as busy, false when it already is
+func lockTusUpload(id string) bool {
+	tusBusyLock.Lock()
+	defer tusBusyLock.Unlock()
+
+	if tusBusy[id] {
+		return false
+	}
+
+	tusBusy[id] = true
+	return true
+}
+
+func unlockTusUpload(id string) {
+	tusBusyLock.Lock()
+	delete(tusBusy, id)
+	tusBusyLock.Unlock()
+}
+
+func tusPath(id string, ext string) string {
+	return filepath.Join(cdnConfig.TusPath, id+ext)
+}
+
+// loads the info of an upload and the current offset, which is the size of the staged data.
+// uploads of other users are treated as not found
+func tusUploadFor(id string, user *User) (*TusUpload, int64, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, 0, fiber.NewError(fiber.StatusNotFound, "Upload not found.")
+	}
+
+	body, err := ioutil.ReadFile(tusPath(id, ".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, fiber.NewError(fiber.StatusNotFound, "Upload not found.")
+		}
+
+		return nil, 0, err
+	}
+
+	upload := new(TusUpload)
+	if err := json.Unmarshal(body, upload); err != nil {
+		return nil, 0, err
+	}
+
+	if !user.owns(upload.Owner) {
+		return nil, 0, fiber.NewError(fiber.StatusNotFound, "Upload not found.")
+	}
+
+	stat, err := os.Stat(tusPath(id, ".bin"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return upload, stat.Size(), nil
+}
+
+func (upload *TusUpload) remove() {
+	os.Remove(tusPath(upload.ID, ".json"))
+	os.Remove(tusPath(upload.ID, ".bin"))
+}
+
+// parses the Upload-Metadata header, a list of keys with base64 encoded values
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+
+		value := ""
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+
+			value = string(decoded)
+		}
+
+		metadata[fields[0]] = value
+	}
+
+	return metadata
+}
+
+func tusMetadataValue(metadata map[string]string) func(key string) string {
+	return func(key string) string {
+		return metadata[key]
+	}
+}
+
+func tusHeaders(ctx *fiber.Ctx) error {
+	ctx.Set("Tus-Resumable", tusVersion)
+	ctx.Set("Cache-Control", "no-store")
+
+	if ctx.Method() != fiber.MethodOptions && ctx.Get("Tus-Resumable") != tusVersion {
+		ctx.Set("Tus-Version", tusVersion)
+		return fiber.NewError(fiber.StatusPreconditionFailed, "Unsupported tus version.")
+	}
+
+	return ctx.Next()
+}
+
+func tusOptionsRoute(ctx *fiber.Ctx) error {
+	ctx.Set("Tus-Version", tusVersion)
+	ctx.Set("Tus-Extension", "creation,termination")
+	if cdnConfig.MaxUploadSize > 0 {
+		ctx.Set("Tus-Max-Size", strconv.FormatInt(cdnConfig.MaxUploadSize, 10))
+	}
+
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+func createTusUploadRoute(ctx *fiber.Ctx) error {
+	length, err := strconv.ParseInt(ctx.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid Upload-Length header.")
+	}
+
+	if cdnConfig.MaxUploadSize > 0 && length > cdnConfig.MaxUploadSize {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Upload is larger than the %v bytes allowed.", cdnConfig.MaxUploadSize))
+	}
+
+	metadata := parseTusMetadata(ctx.Get("Upload-Metadata"))
+	if _, respErr := parseUploadOptions(tusMetadataValue(metadata)); respErr != nil {
+		return fiber.NewError(respErr.Code, respErr.Message)
+	}
+
+	if respErr := checkQuota(ctx.Context(), currentUser(ctx).UID, length); respErr != nil {
+		return sendUploadError(ctx, respErr)
+	}
+
+	upload := &TusUpload{
+		ID:       randSeq(16),
+		Length:   length,
+		FileName: metadata["filename"],
+		Owner:    currentUser(ctx).UID,
+		Metadata: metadata,
+		Created:  time.Now().UTC(),
+	}
+
+	if err := os.MkdirAll(cdnConfig.TusPath, 0755); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	if err := ioutil.WriteFile(tusPath(upload.ID, ".bin"), nil, 0600); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	if err := ioutil.WriteFile(tusPath(upload.ID, ".json"), toJSON(upload), 0600); err != nil {
+		upload.remove()
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	ctx.Set("Location", fmt.Sprintf("%v/api/tus/%v", cdnConfig.CdnEndpoint, upload.ID))
+	ctx.Set("Upload-Expires", upload.Created.Add(tusExpiry).Format(http.TimeFormat))
+
+	return ctx.SendStatus(fiber.StatusCreated)
+}
+
+func getTusUploadRoute(ctx *fiber.Ctx) error {
+	upload, offset, err := tusUploadFor(ctx.Params("id"), currentUser(ctx))
+	if err != nil {
+		return err
+	}
+
+	ctx.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	ctx.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+
+	return ctx.SendStatus(fiber.StatusOK)
+}
+
+func patchTusUploadRoute(ctx *fiber.Ctx) error {
+	if ctx.Get("Content-Type") != "application/offset+octet-stream" {
+		return fiber.NewError(fiber.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream.")
+	}
+
+	id := ctx.Params("id")
+
+	if !lockTusUpload(id) {
+		return fiber.NewError(fiber.StatusConflict, "Upload is already being written to.")
+	}
+
+	defer unlockTusUpload(id)
+
+	upload, offset, err := tusUploadFor(id, currentUser(ctx))
+	if err != nil {
+		return err
+	}
+
+	if ctx.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		return fiber.NewError(fiber.StatusConflict, "Upload-Offset does not match the current offset.")
+	}
+
+	chunk := ctx.Body()
+	if offset+int64(len(chunk)) > upload.Length {
+		return fiber.NewError(fiber.StatusBadRequest, "Chunk exceeds the Upload-Length.")
+	}
+
+	data, err := os.OpenFile(tusPath(id, ".bin"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	defer data.Close()
+
+	written, err := data.Write(chunk)
+	offset += int64(written)
+	ctx.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	if offset < upload.Length {
+		return ctx.SendStatus(fiber.StatusNoContent)
+	}
+
+	return finishTusUpload(ctx, upload)
+}
+
+// moves a completed upload into storage and responds like a regular upload
+func finishTusUpload(ctx *fiber.Ctx, upload *TusUpload) error {
+	data, err := os.Open(tusPath(upload.ID, ".bin"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	// relative expiry times start once the upload is complete
+	opts, respErr := parseUploadOptions(tusMetadataValue(upload.Metadata))
+	if respErr != nil {
+		data.Close()
+		ctx.Status(respErr.Code)
+		return ctx.JSON(respErr)
+	}
+
+	opts.Owner = upload.Owner
+
+	file, respErr := SaveUpload(ctx.Context(), data, upload.FileName, upload.Length, opts)
+	data.Close()
+
+	if respErr != nil {
+		// the upload can't be finished over the quota, so don't keep it around
+		if _, ok := respErr.Data.(*QuotaExceeded); ok {
+			upload.remove()
+		}
+
+		ctx.Status(respErr.Code)
+		return sendUploadError(ctx, respErr)
+	}
+
+	upload.remove()
+
+	return ctx.JSON(ImageResult{
+		Code:    200,
+		Url:     fmt.Sprintf("%v/%v", cdnConfig.CdnEndpoint, file),
+		Success: true,
+	})
+}
+
+func deleteTusUploadRoute(ctx *fiber.Ctx) error {
+	id := ctx.Params("id")
+
+	if !lockTusUpload(id) {
+		return fiber.NewError(fiber.StatusConflict, "Upload is being written to.")
+	}
+
+	defer unlockTusUpload(id)
+
+	upload, _, err := tusUploadFor(id, currentUser(ctx))
+	if err != nil {
+		return err
+	}
+
+	upload.remove()
+
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// removes staged uploads that were never finished
+func cleanUpTusUploads() {
+	infos, err := filepath.Glob(filepath.Join(cdnConfig.TusPath, "*.json"))
+	if err != nil {
+		return
+	}
+
+	for _, info := range infos {
+		upload, _, err := tusUploadFor(strings.TrimSuffix(filepath.Base(info), ".json"), adminUser)
+		if err != nil {
+			continue
+		}
+
+		// an upload still being written to is left for the next run
+		if time.Since(upload.Created) > tusExpiry && lockTusUpload(upload.ID) {
+			log.Printf("Removing expired upload %v", upload.ID)
+			upload.remove()
+			unlockTusUpload(upload.ID)
+		}
+	}
+}
+
+func startTusCleanUp() {
+	go func() {
+		for {
+			cleanUpTusUploads()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
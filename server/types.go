@@ -3,17 +3,175 @@ package main
 import "time"
 
 type User struct {
-	UID   string `json:"id"`
+	UID  string `json:"id"`
+	Name string `json:"name"`
+	// the sha256 of the token the user authorizes with, the token itself is only shown once
+	Token    string    `json:"token"`
+	Admin    bool      `json:"admin"`
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+	// replaces the default quota when set
+	Quota *Quota `json:"quota,omitempty"`
+}
+
+type UserResult struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Admin    bool      `json:"admin"`
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+	Quota    *Quota    `json:"quota,omitempty"`
+}
+
+// limits on what a user can upload, 0 is no limit
+type Quota struct {
+	Bytes         int64 `json:"bytes"`
+	Files         int64 `json:"files"`
+	FileSize      int64 `json:"file_size"`
+	UploadsPerDay int64 `json:"uploads_per_day"`
+}
+
+// the counters quotas are checked against, kept in the metadata store
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+	// uploads on the day, deleting files doesn't give them back
+	Uploads int64 `json:"uploads"`
+	// the utc day uploads are counted for, as 2006-01-02
+	Day string `json:"day"`
+}
+
+type UsageResult struct {
+	User    string `json:"user"`
+	Usage   *Usage `json:"usage"`
+	Quota   *Quota `json:"quota"`
+	Success bool   `json:"success"`
+	Code    int    `json:"code"`
+}
+
+// the data of an error when an upload goes over a quota
+type QuotaExceeded struct {
+	// which limit was reached, one of bytes, files, file_size or uploads_per_day
+	Limit string `json:"limit"`
+	Quota int64  `json:"quota"`
+	Usage int64  `json:"usage"`
+	// seconds until an upload is allowed again, only for uploads_per_day
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+type UserRequest struct {
 	Name  string `json:"name"`
-	Token string `json:"token"`
 	Admin bool   `json:"admin"`
 }
 
+type UserPatchRequest struct {
+	Name     string `json:"name"`
+	Admin    *bool  `json:"admin"`
+	Disabled *bool  `json:"disabled"`
+	Quota    *Quota `json:"quota"`
+	// goes back to the default quota
+	DefaultQuota bool `json:"default_quota"`
+}
+
+// a single use code that lets someone create their own user
+type Invite struct {
+	ID string `json:"id"`
+	// the sha256 of the code, the code itself is only shown once
+	Hash string `json:"hash"`
+	// whether the user it creates is an admin
+	Admin     bool      `json:"admin"`
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+type InviteRequest struct {
+	Admin     bool  `json:"admin"`
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type InviteResult struct {
+	ID        string    `json:"id"`
+	Admin     bool      `json:"admin"`
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+type NewInviteResult struct {
+	Invite *InviteResult `json:"invite"`
+	Code   string        `json:"code"`
+}
+
+type RegisterRequest struct {
+	Name   string `json:"name"`
+	Invite string `json:"invite"`
+}
+
+type NewUserResult struct {
+	User  *UserResult `json:"user"`
+	Token string      `json:"token"`
+}
+
+type APIKey struct {
+	ID     string   `json:"id"`
+	Label  string   `json:"label"`
+	Owner  string   `json:"owner"`
+	Scopes []string `json:"scopes"`
+	// the sha256 of the key, the key itself is only shown once
+	Hash     string     `json:"hash"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+type APIKeyRequest struct {
+	Label     string   `json:"label"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int64    `json:"expires_in"`
+}
+
+type APIKeyResult struct {
+	ID       string     `json:"id"`
+	Label    string     `json:"label"`
+	Owner    string     `json:"owner"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+type NewAPIKeyResult struct {
+	Key   *APIKeyResult `json:"key"`
+	Token string        `json:"token"`
+}
+
 type Config struct {
-	SpacesConfig  SpacesConfig
-	CdnEndpoint   string
-	Authorization string
-	Production    bool
+	SpacesConfig     SpacesConfig
+	CdnEndpoint      string
+	Authorization    string
+	Production       bool
+	StorageDriver    string
+	LocalStoragePath string
+	MetadataDriver   string
+	MetadataPath     string
+	BodyLimit        int
+	MaxUploadSize    int64
+	TusPath          string
+	ObjectCacheSize  int
+	ObjectCacheTTL   time.Duration
+
+	TrashRetention time.Duration
+
+	SigningKey []byte
+
+	FirebaseAuth bool
+
+	DefaultQuota Quota
+
+	ReconcileInterval      time.Duration
+	ReconcileDryRun        bool
+	ReconcileDeleteOrphans bool
 }
 
 type SpacesConfig struct {
@@ -24,15 +182,39 @@ type SpacesConfig struct {
 	SpacesCdn       string
 	SpacesName      string
 	SpacesRegion    string
+
+	// uploads at least this big are sent in parts
+	MultipartThreshold   int64
+	MultipartPartSize    int64
+	MultipartConcurrency int
+
+	// the most connections kept open to Spaces
+	MaxConnections int
 }
 
 type FileResult struct {
-	CdnUrl       string    `json:"cdn_url"`
-	SpacesUrl    string    `json:"spaces_url"`
-	SpacesCdn    string    `json:"spaces_cdn"`
-	FileName     string    `json:"file_name"`
-	LastModified time.Time `json:"last_modified"`
-	Size         int64     `json:"size"`
+	CdnUrl       string     `json:"cdn_url"`
+	SpacesUrl    string     `json:"spaces_url"`
+	SpacesCdn    string     `json:"spaces_cdn"`
+	FileName     string     `json:"file_name"`
+	Name         string     `json:"name,omitempty"`
+	Owner        string     `json:"owner,omitempty"`
+	ContentType  string     `json:"content_type,omitempty"`
+	LastModified time.Time  `json:"last_modified"`
+	Size         int64      `json:"size"`
+	Status       string     `json:"status,omitempty"`
+	Deleted      *time.Time `json:"deleted,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads,omitempty"`
+	Protected    bool       `json:"protected,omitempty"`
+	Private      bool       `json:"private,omitempty"`
+}
+
+type FilesResult struct {
+	Files      []*FileResult `json:"files"`
+	Length     int           `json:"length"`
+	NextCursor string        `json:"next_cursor,omitempty"`
 }
 
 type FolderResult struct {
@@ -40,15 +222,23 @@ type FolderResult struct {
 	UpdateTime time.Time     `json:"update_time"`
 	ID         string        `json:"id"`
 	Name       string        `json:"name"`
+	Owner      string        `json:"owner"`
 	Files      []*FileResult `json:"files,omitempty"`
 }
 
 type FoldersResult struct {
-	CreateTime time.Time `json:"create_time"`
-	UpdateTime time.Time `json:"update_time"`
-	ID         string    `json:"id"`
-	Name       string    `json:"name"`
-	Size       int       `json:"size"`
+	CreateTime time.Time  `json:"create_time"`
+	UpdateTime time.Time  `json:"update_time"`
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Owner      string     `json:"owner"`
+	Size       int        `json:"size"`
+	Deleted    *time.Time `json:"deleted,omitempty"`
+}
+
+type TrashResult struct {
+	Files   []*FileResult    `json:"files"`
+	Folders []*FoldersResult `json:"folders"`
 }
 
 type ImageResult struct {
@@ -63,6 +253,54 @@ type DeletedImageResponse struct {
 	Code    int    `json:"code"`
 }
 
+type PresignRequest struct {
+	FileName      string `json:"file_name"`
+	Size          int64  `json:"size"`
+	ContentType   string `json:"content_type"`
+	ExpiresIn     int64  `json:"expires_in"`
+	ExpiresAt     string `json:"expires_at"`
+	MaxDownloads  int    `json:"max_downloads"`
+	BurnAfterRead bool   `json:"burn_after_read"`
+	Password      string `json:"password"`
+	Visibility    string `json:"visibility"`
+}
+
+type FileLinkRequest struct {
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type FileLinkResult struct {
+	Url       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Success   bool      `json:"success"`
+	Code      int       `json:"code"`
+}
+
+type PresignResult struct {
+	Key       string            `json:"key"`
+	Url       string            `json:"url"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// an upload presigned for a client that hasn't been completed yet
+type PendingUpload struct {
+	Key      string `json:"key"`
+	FileName string `json:"file_name"`
+	// -1 for uploads streamed through /api/upload, which have nothing reserved until they're stored
+	Size        int64          `json:"size"`
+	ContentType string         `json:"content_type"`
+	Options     *UploadOptions `json:"options"`
+	Created     time.Time      `json:"created"`
+	// when the presigned url stops working, the upload can still be completed for a while after
+	Expires time.Time `json:"expires"`
+}
+
+type PresignCompleteRequest struct {
+	Key string `json:"key"`
+}
+
 type FolderPostRequest struct {
 	Name string `json:"name"`
 }
@@ -90,4 +328,48 @@ type TokenRequest struct {
 
 type ImageResponseQuery struct {
 	Download string `query:"download"`
+	Raw      string `query:"raw"`
+}
+
+type FilesQuery struct {
+	Cursor string `query:"cursor"`
+	Limit  int    `query:"limit"`
+	Prefix string `query:"prefix"`
+	Sort   string `query:"sort"`
+	Order  string `query:"order"`
+	Type   string `query:"type"`
+	After  string `query:"after"`
+	Before string `query:"before"`
+	// only admins can list the files of others, everyone else only gets their own
+	Owner string `query:"owner"`
+
+	after  time.Time
+	before time.Time
+	cursor *FileCursor
+}
+
+type ReconcileReport struct {
+	Started            time.Time            `json:"started"`
+	Finished           time.Time            `json:"finished"`
+	DryRun             bool                 `json:"dry_run"`
+	Objects            int                  `json:"objects"`
+	Files              int                  `json:"files"`
+	Folders            int                  `json:"folders"`
+	DanglingReferences []*DanglingReference `json:"dangling_references"`
+	MissingObjects     []string             `json:"missing_objects"`
+	OrphanedObjects    []string             `json:"orphaned_objects"`
+	UnindexedObjects   []string             `json:"unindexed_objects"`
+	SizeMismatches     []*SizeMismatch      `json:"size_mismatches"`
+	Errors             []string             `json:"errors"`
+}
+
+type DanglingReference struct {
+	Folder string `json:"folder"`
+	Key    string `json:"key"`
+}
+
+type SizeMismatch struct {
+	Key         string `json:"key"`
+	IndexSize   int64  `json:"index_size"`
+	StorageSize int64  `json:"storage_size"`
 }
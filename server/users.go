@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// the id of the user behind the AUTHORIZATION token, files from before there were users have no owner and
+// are only visible to admins
+const adminUID = "admin"
+
+var errInvalidToken = errors.New("invalid token")
+var errUserDisabled = errors.New("user is disabled")
+
+var adminUser = &User{
+	UID:   adminUID,
+	Name:  "Admin",
+	Admin: true,
+}
+
+// creates a user with a new token, which is returned as only its hash is stored
+func NewUser(ctx context.Context, name string, admin bool) (*User, string, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	user := &User{
+		UID:     randSeq(8),
+		Name:    name,
+		Token:   hashToken(token),
+		Admin:   admin,
+		Created: time.Now().UTC(),
+	}
+
+	if err := cdnMetadata.SaveUser(ctx, user); err != nil {
+		return nil, "", err
+	}
+
+	return user, token, nil
+}
+
+func newToken() (string, error) {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+// tokens are long and random so a plain hash is enough to store them
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// finds who a token belongs to and the api key it is, which is nil for tokens with every scope.
+// disabled users can't authorize with any of their tokens or keys
+func authenticate(ctx context.Context, token string) (*User, *APIKey, error) {
+	user, key, err := lookUpToken(ctx, token)
+	if err == nil && user.Disabled {
+		return nil, nil, errUserDisabled
+	}
+
+	return user, key, err
+}
+
+// the AUTHORIZATION token belongs to the admin, tokens that are neither user tokens nor api keys
+// are tried as Firebase ID tokens when Firebase Auth is on
+func lookUpToken(ctx context.Context, token string) (*User, *APIKey, error) {
+	if cdnConfig.Authorization != "" && token == cdnConfig.Authorization {
+		return adminUser, nil, nil
+	}
+
+	hash := hashToken(token)
+
+	user, err := cdnMetadata.GetUserByToken(ctx, hash)
+	if err != ErrRecordNotFound {
+		return user, nil, err
+	}
+
+	key, err := cdnMetadata.GetKeyByHash(ctx, hash)
+	if err == nil {
+		user, err := userForKey(ctx, key)
+		return user, key, err
+	} else if err != ErrRecordNotFound {
+		return nil, nil, err
+	}
+
+	if cdnConfig.FirebaseAuth {
+		user, err := userForIDToken(ctx, token)
+		return user, nil, err
+	}
+
+	return nil, nil, errInvalidToken
+}
+
+// the user the request was authorized as
+func currentUser(ctx *fiber.Ctx) *User {
+	user, _ := ctx.Locals("user").(*User)
+	return user
+}
+
+// whether the user can see and change something owned by the owner
+func (user *User) owns(owner string) bool {
+	return user.Admin || (owner != "" && owner == user.UID)
+}
+
+func (user *User) ToResult() *UserResult {
+	return &UserResult{
+		ID:       user.UID,
+		Name:     user.Name,
+		Admin:    user.Admin,
+		Disabled: user.Disabled,
+		Created:  user.Created,
+		Quota:    user.Quota,
+	}
+}
+
+// deletes the user along with their api keys, their files and folders are kept for admins to clean up
+func DeleteUser(ctx context.Context, uid string) error {
+	keys, err := cdnMetadata.ListKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if key.Owner == uid {
+			if err := cdnMetadata.DeleteKey(ctx, key.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return cdnMetadata.DeleteUser(ctx, uid)
+}
+
+// only lets admins through, keys of admins need the admin scope to count
+func adminOnly(ctx *fiber.Ctx) error {
+	if !currentUser(ctx).Admin {
+		return fiber.NewError(fiber.StatusForbidden, "Only admins can do this.")
+	}
+
+	return ctx.Next()
+}
+
+// gets a user for an admin to change, admins can't change themselves so they can't lock themselves out
+func managedUser(ctx *fiber.Ctx) (*User, *JSONResponse) {
+	id := ctx.Params("id")
+	if id == currentUser(ctx).UID {
+		return nil, NewResponse(fiber.StatusBadRequest, "Cannot change your own user.")
+	}
+
+	user, err := cdnMetadata.GetUser(ctx.Context(), id)
+	if err == ErrRecordNotFound {
+		return nil, NewResponse(fiber.StatusNotFound, "User not found.")
+	} else if err != nil {
+		return nil, NewResponseByError(fiber.StatusInternalServerError, err)
+	}
+
+	return user, nil
+}
+
+func getUsersRoute(ctx *fiber.Ctx) error {
+	users, err := cdnMetadata.ListUsers(ctx.Context())
+	if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Created.Before(users[j].Created)
+	})
+
+	results := make([]*UserResult, len(users))
+	for i, user := range users {
+		results[i] = user.ToResult()
+	}
+
+	return ctx.JSON(results)
+}
+
+func createUsersRoute(ctx *fiber.Ctx) error {
+	body := new(UserRequest)
+
+	if err := ctx.BodyParser(body); err != nil {
+		respErr := NewResponseByError(fiber.StatusBadRequest, err)
+		return ctx.JSON(respErr)
+	}
+
+	if body.Name == "" {
+		respErr := NewResponse(fiber.StatusBadRequest, "User name required.")
+		return ctx.JSON(respErr)
+	}
+
+	user, token, err := NewUser(ctx.Context(), body.Name, body.Admin)
+	if err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(&NewUserResult{
+		User:  user.ToResult(),
+		Token: token,
+	})
+}
+
+// renames, promotes, demotes, disables or enables a user, or changes their quota
+func updateUserRoute(ctx *fiber.Ctx) error {
+	body := new(UserPatchRequest)
+
+	if err := ctx.BodyParser(body); err != nil {
+		respErr := NewResponseByError(fiber.StatusBadRequest, err)
+		return ctx.JSON(respErr)
+	}
+
+	user, respErr := managedUser(ctx)
+	if respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	if body.Name != "" {
+		user.Name = body.Name
+	}
+
+	if body.Admin != nil {
+		user.Admin = *body.Admin
+	}
+
+	if body.Disabled != nil {
+		user.Disabled = *body.Disabled
+	}
+
+	if body.DefaultQuota {
+		user.Quota = nil
+	} else if body.Quota != nil {
+		user.Quota = body.Quota
+	}
+
+	if err := cdnMetadata.SaveUser(ctx.Context(), user); err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(user.ToResult())
+}
+
+func deleteUserRoute(ctx *fiber.Ctx) error {
+	user, respErr := managedUser(ctx)
+	if respErr != nil {
+		return ctx.JSON(respErr)
+	}
+
+	if err := DeleteUser(ctx.Context(), user.UID); err != nil {
+		respErr := NewResponseByError(fiber.StatusInternalServerError, err)
+		return ctx.JSON(respErr)
+	}
+
+	return ctx.JSON(fiber.Map{
+		"id":      user.UID,
+		"success": true,
+		"code":    200,
+	})
+}
+
+func getUserRoute(ctx *fiber.Ctx) error {
+	return ctx.JSON(currentUser(ctx).ToResult())
+}
+
+// manages users from the command line with `cdn users list` and `cdn users create -name <name> [-admin]`
+func usersCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: cdn users list | create -name <name> [-admin]")
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "list":
+		users, err := cdnMetadata.ListUsers(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sort.Slice(users, func(i, j int) bool {
+			return users[i].Created.Before(users[j].Created)
+		})
+
+		for _, user := range users {
+			fmt.Printf("%v\t%v\tadmin=%v\t%v\n", user.UID, user.Name, user.Admin, user.Created.Format(time.RFC3339))
+		}
+	case "create":
+		flags := flag.NewFlagSet("users create", flag.ExitOnError)
+		name := flags.String("name", "", "the name of the user")
+		admin := flags.Bool("admin", false, "whether the user can see and change everything")
+		flags.Parse(args[1:])
+
+		if *name == "" {
+			log.Fatal("A name is required")
+		}
+
+		user, token, err := NewUser(ctx, *name, *admin)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(os.Stdout, "Created user %v, their token is %v\n", user.UID, token)
+	default:
+		log.Fatalf("Unknown users command %v", args[0])
+	}
+}